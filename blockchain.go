@@ -40,6 +40,8 @@ const genesisBlockHeight = 0
 
 var blockchainSubdirectory string
 
+// Set when the blockchain has been initialised and verified at startup
+var blockchainVerified bool
 
 // Block is the working representation of a blockchain block
 type Block struct {
@@ -171,12 +173,8 @@ func blockchainInit(createDefault bool) {
 			if err != nil {
 				log.Fatal("Error decoding chainparams file", cpFilename, err)
 			}
-			peers := dbGetSavedPeers()
 			for _, peer := range chainParams.BootstrapPeers {
-				_, ok := peers[peer]
-				if !ok {
-					dbSavePeer(peer)
-				}
+				dbSavePeer(peer, p2pPeerSourceBootstrap)
 			}
 		} else {
 			log.Println("Using default blockchain params")
@@ -187,16 +185,44 @@ func blockchainInit(createDefault bool) {
 	if err != nil {
 		log.Fatalf("blockchainVerifyEverything: %v", err)
 	}
+	blockchainVerified = true
+}
+
+// blockchainKeyState is the state of a single public key as it is replayed from the blockchain
+type blockchainKeyState struct {
+	publicKeyBytes []byte
+	addHeight      int
+	revokeHeight   int // -1 if not revoked
+	revokeTime     time.Time
+}
+
+// Returns nil if the key can be used to sign the block at the given height.
+// A block cannot be signed by a key it adds (except for the genesis block, which is self-signed),
+// but it can be signed by a key it revokes.
+func (ks *blockchainKeyState) checkValidAt(height int) error {
+	if ks.addHeight >= height && !(height == genesisBlockHeight && ks.addHeight == genesisBlockHeight) {
+		return fmt.Errorf("key is added later, at height %d", ks.addHeight)
+	}
+	if ks.revokeHeight != -1 && ks.revokeHeight < height {
+		return fmt.Errorf("key is revoked earlier, at height %d", ks.revokeHeight)
+	}
+	return nil
 }
 
 // Verifies the entire blockchain to see if there are errors.
-// TODO: Dynamic adding and revoking of key is not yet checked
+// The key state is replayed height by height, so that signatures are checked against the keys
+// which were valid at the time each block was accepted, instead of the current pubkeys table.
 func blockchainVerifyEverything() error {
 	if cfg.faster {
 		log.Println("Skipping blockchain consistency checks")
 		return nil
 	}
+	if cfg.Light {
+		log.Println("Light mode: the blocks are not stored, their headers and key ops were verified when received")
+		return nil
+	}
 	log.Println("Verifying all the blocks (use --faster to skip)...")
+	keyStates := make(map[string]*blockchainKeyState)
 	maxHeight := dbGetBlockchainHeight()
 	for height := 0; height <= maxHeight; height++ {
 		if height > 0 && height%1000 == 0 {
@@ -221,11 +247,40 @@ func blockchainVerifyEverything() error {
 			return fmt.Errorf("block %d: it's supposed to be the genesis block but its hash doesn't match %s",
 				height, chainParams.GenesisBlockHash)
 		}
-		dbpk, err := dbGetPublicKey(dbb.SignaturePublicKeyHash)
+		b, err := OpenBlockByHeight(height)
+		if err != nil {
+			return fmt.Errorf("block %d: cannot open block db file: %v", height, err)
+		}
+		blockKeyOps, err := b.dbGetKeyOps()
+		if err != nil {
+			if err := b.Close(); err != nil {
+				panic(err)
+			}
+			return fmt.Errorf("block %d: cannot get key ops: %v", height, err)
+		}
+		blockTime, err := b.dbGetMetaTime("Timestamp")
 		if err != nil {
-			return fmt.Errorf("block %d: error getting public key %s", height, dbb.SignaturePublicKeyHash)
+			blockTime = dbb.TimeAccepted
+		}
+		if err = b.Close(); err != nil {
+			panic(err)
+		}
+		if height == genesisBlockHeight {
+			// The genesis block introduces the initial keys, which sign the genesis block itself
+			for keyOpKeyHash, keyOps := range blockKeyOps {
+				if keyOps[0].op == "A" {
+					keyStates[keyOpKeyHash] = &blockchainKeyState{publicKeyBytes: keyOps[0].publicKeyBytes, addHeight: height, revokeHeight: -1}
+				}
+			}
 		}
-		creatorPublicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+		signerState, ok := keyStates[dbb.SignaturePublicKeyHash]
+		if !ok {
+			return fmt.Errorf("block %d: signing public key %s is not in the blockchain", height, dbb.SignaturePublicKeyHash)
+		}
+		if err = signerState.checkValidAt(height); err != nil {
+			return fmt.Errorf("block %d: signing public key %s is not valid: %v", height, dbb.SignaturePublicKeyHash, err)
+		}
+		creatorPublicKey, err := cryptoDecodePublicKeyBytes(signerState.publicKeyBytes)
 		if err != nil {
 			return fmt.Errorf("block %d: cannot decode public key %s", height, dbb.SignaturePublicKeyHash)
 		}
@@ -246,20 +301,6 @@ func blockchainVerifyEverything() error {
 		if err != nil {
 			return fmt.Errorf("block %d: previous block hash signature is invalid (%v)", height, err)
 		}
-		b, err := OpenBlockByHeight(height)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot open block db file: %v", height, err)
-		}
-		blockKeyOps, err := b.dbGetKeyOps()
-		if err != nil {
-			if err := b.Close(); err != nil {
-				panic(err)
-			}
-			return fmt.Errorf("block %d: cannot get key ops: %v", height, err)
-		}
-		if err = b.Close(); err != nil {
-			panic(err)
-		}
 		Q := QuorumForHeight(height)
 		for keyOpKeyHash, keyOps := range blockKeyOps {
 			if len(keyOps) != Q {
@@ -267,109 +308,239 @@ func blockchainVerifyEverything() error {
 					height, keyOpKeyHash, len(keyOps), Q)
 			}
 			op := keyOps[0].op
+			signers := make(map[string]bool)
 			for _, kop := range keyOps {
 				if kop.op != op {
 					return fmt.Errorf("block %d: key ops for %s don't match: %s vs %s",
 						height, keyOpKeyHash, kop.op, op)
 				}
-				dbSigningKey, err := dbGetPublicKey(kop.signatureKeyHash)
-				if err != nil {
-					return fmt.Errorf("block %d: cannot get public key %s from main db", height, kop.signatureKeyHash)
+				if signers[kop.signatureKeyHash] {
+					return fmt.Errorf("block %d: key op for %s signed more than once by %s", height, keyOpKeyHash, kop.signatureKeyHash)
+				}
+				signers[kop.signatureKeyHash] = true
+				sigState, ok := keyStates[kop.signatureKeyHash]
+				if !ok {
+					return fmt.Errorf("block %d: key op signer %s is not in the blockchain", height, kop.signatureKeyHash)
+				}
+				if err = sigState.checkValidAt(height); err != nil {
+					return fmt.Errorf("block %d: key op signer %s is not valid: %v", height, kop.signatureKeyHash, err)
 				}
-				signingKey, err := cryptoDecodePublicKeyBytes(dbSigningKey.publicKeyBytes)
+				signingKey, err := cryptoDecodePublicKeyBytes(sigState.publicKeyBytes)
 				if err != nil {
-					return fmt.Errorf("block %d: cannot decode public key %s", height, dbSigningKey.publicKeyHash)
+					return fmt.Errorf("block %d: cannot decode public key %s", height, kop.signatureKeyHash)
 				}
 				if err = cryptoVerifyPublicKeyHashSignature(signingKey, kop.publicKeyHash, kop.signature); err != nil {
 					return fmt.Errorf("block %d: key op signature invalid for signer %s: %v", height, kop.signatureKeyHash, err)
 				}
 			}
 		}
+		// All the signatures are verified, apply the key ops for the following blocks
+		for keyOpKeyHash, keyOps := range blockKeyOps {
+			ks, ok := keyStates[keyOpKeyHash]
+			switch keyOps[0].op {
+			case "A":
+				if ok && height != genesisBlockHeight {
+					return fmt.Errorf("block %d: attempt to add an already existing key %s", height, keyOpKeyHash)
+				}
+				keyStates[keyOpKeyHash] = &blockchainKeyState{publicKeyBytes: keyOps[0].publicKeyBytes, addHeight: height, revokeHeight: -1}
+			case "R":
+				if !ok {
+					return fmt.Errorf("block %d: attempt to revoke an unknown key %s", height, keyOpKeyHash)
+				}
+				if ks.revokeHeight != -1 {
+					return fmt.Errorf("block %d: attempt to revoke a key which is already revoked: %s", height, keyOpKeyHash)
+				}
+				ks.revokeHeight = height
+				ks.revokeTime = blockTime
+			default:
+				return fmt.Errorf("block %d: invalid key op %s for %s", height, keyOps[0].op, keyOpKeyHash)
+			}
+		}
+	}
+	// Finally, check that the revocations in the pubkeys table agree with the replayed key state
+	for keyHash, ks := range keyStates {
+		dbpk, err := dbGetPublicKey(keyHash)
+		if err != nil {
+			return fmt.Errorf("public key %s from the blockchain is not in the main db", keyHash)
+		}
+		revoked := ks.revokeHeight != -1
+		dbRevoked := dbpk.state == "R" || dbpk.isRevoked
+		if dbpk.revBlockHeight == ks.revokeHeight && dbRevoked == revoked {
+			continue
+		}
+		if !revoked {
+			return fmt.Errorf("public key %s is marked as revoked in the main db, but the blockchain never revokes it", keyHash)
+		}
+		if dbpk.revBlockHeight == -1 {
+			// Revocations recorded before revocation heights were tracked
+			log.Println("Recording revocation of", keyHash, "at height", ks.revokeHeight)
+			dbRevokePublicKey(keyHash, ks.revokeHeight, ks.revokeTime)
+			continue
+		}
+		return fmt.Errorf("public key %s is recorded as revoked at height %d, but the blockchain revokes it at %d",
+			keyHash, dbpk.revBlockHeight, ks.revokeHeight)
 	}
 	return nil
 }
 
+// An error rejecting a block, with a short reason which is used in the metrics
+type blockRejectedError struct {
+	reason string
+	err    error
+}
+
+func (e blockRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func blockRejected(reason string, format string, args ...interface{}) error {
+	return blockRejectedError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
 // Checks if a new block can be accepted to extend the blockchain
 func checkAcceptBlock(blk *Block) (int, error) {
 	// Step 1: Does the block fit, i.e. does it extend the chain?
 	if blk.Version != CurrentBlockVersion {
-		return 0, fmt.Errorf("Unsupported block version: %d", blk.Version)
+		return 0, blockRejected("version", "Unsupported block version: %d", blk.Version)
 	}
 	prevBlk, err := dbGetBlock(blk.PreviousBlockHash)
 	if err != nil {
-		return 0, fmt.Errorf("Cannot find previous block %s: %v", blk.PreviousBlockHash, err)
+		return 0, blockRejected("no_previous_block", "Cannot find previous block %s: %v", blk.PreviousBlockHash, err)
 	}
 	thisBlockHeight := prevBlk.Height + 1
 	if _, err = dbGetBlockByHeight(thisBlockHeight); err == nil {
-		return 0, fmt.Errorf("The block to accept would replace an existing block, and this is not supported yet (height=%d)", prevBlk.Height+1)
+		return 0, blockRejected("existing_height", "The block to accept would replace an existing block, and this is not supported yet (height=%d)", prevBlk.Height+1)
 	}
 	// Step 2: Is the block signed by a valid signatory?
 	signatoryPubKey, err := dbGetPublicKey(blk.SignaturePublicKeyHash)
 	if err != nil {
-		return 0, fmt.Errorf("Cannot find an accepted public key %s signing the block", blk.SignaturePublicKeyHash)
+		return 0, blockRejected("unknown_signer", "Cannot find an accepted public key %s signing the block", blk.SignaturePublicKeyHash)
 	}
 	if signatoryPubKey.isRevoked {
-		return 0, fmt.Errorf("The public key %s signing the block is revoked on %v", blk.SignaturePublicKeyHash, signatoryPubKey.timeRevoked)
+		return 0, blockRejected("revoked_signer", "The public key %s signing the block is revoked on %v", blk.SignaturePublicKeyHash, signatoryPubKey.timeRevoked)
 	}
 	sigPubKey, err := cryptoDecodePublicKeyBytes(signatoryPubKey.publicKeyBytes)
 	if err != nil {
-		return 0, fmt.Errorf("Cannot decode public key %s: %v", blk.SignaturePublicKeyHash, err)
+		return 0, blockRejected("unknown_signer", "Cannot decode public key %s: %v", blk.SignaturePublicKeyHash, err)
 	}
 	err = cryptoVerifyHexBytes(sigPubKey, blk.PreviousBlockHash, blk.PreviousBlockHashSignature)
 	if err != nil {
-		return 0, fmt.Errorf("Verification of previous block hash has failed: %v", err)
+		return 0, blockRejected("bad_signature", "Verification of previous block hash has failed: %v", err)
 	}
 	err = cryptoVerifyHexBytes(sigPubKey, blk.Hash, blk.HashSignature)
 	if err != nil {
-		return 0, fmt.Errorf("Verification of block hash has failed: %v", err)
+		return 0, blockRejected("bad_signature", "Verification of block hash has failed: %v", err)
 	}
 	allKeyOps, err := blk.dbGetKeyOps()
 	if err != nil {
-		return 0, err
+		return 0, blockRejectedError{reason: "key_ops", err: err}
+	}
+	if err = blockchainApplyKeyOps(allKeyOps, thisBlockHeight, blk.TimeAccepted); err != nil {
+		return 0, blockRejectedError{reason: "key_ops", err: err}
 	}
-	targetQuorum := QuorumForHeight(thisBlockHeight)
+	// Everything's ok, the block is ok to import.
+	return thisBlockHeight, nil
+}
+
+// Verifies the key ops of the block at the given height against the currently valid keys, and
+// applies them to the keys in the main database. The signatures of all the ops are verified
+// before any of them is applied. Light nodes, which don't have the blocks, use this to follow
+// the key changes from the key ops their peers send.
+func blockchainApplyKeyOps(allKeyOps map[string][]BlockKeyOp, height int, timeAccepted time.Time) error {
+	targetQuorum := QuorumForHeight(height)
 	for key, keyOps := range allKeyOps {
 		if len(keyOps) < targetQuorum {
-			return 0, fmt.Errorf("Quorum of %d not met for key ops on key %s", targetQuorum, key)
+			return fmt.Errorf("Quorum of %d not met for key ops on key %s", targetQuorum, key)
 		}
+		signers := make(map[string]bool)
 		for _, keyOp := range keyOps {
-			signatoryPubKey, err = dbGetPublicKey(keyOp.signatureKeyHash)
+			// Each signer counts once towards the quorum
+			if signers[keyOp.signatureKeyHash] {
+				return fmt.Errorf("Key op for %s signed more than once by %s", key, keyOp.signatureKeyHash)
+			}
+			signers[keyOp.signatureKeyHash] = true
+			signatoryPubKey, err := dbGetPublicKey(keyOp.signatureKeyHash)
 			if err != nil {
-				return 0, fmt.Errorf("Error retrieving supposedly key op signatory %s", keyOp.signatureKeyHash)
+				return fmt.Errorf("Error retrieving supposedly key op signatory %s", keyOp.signatureKeyHash)
+			}
+			if signatoryPubKey.isRevoked {
+				return fmt.Errorf("The key op signatory %s is revoked on %v", keyOp.signatureKeyHash, signatoryPubKey.timeRevoked)
 			}
 			sigPubKey, err := cryptoDecodePublicKeyBytes(signatoryPubKey.publicKeyBytes)
 			if err != nil {
-				return 0, fmt.Errorf("Cannot decode public key %s: %v", signatoryPubKey.publicKeyHash, err)
+				return fmt.Errorf("Cannot decode public key %s: %v", signatoryPubKey.publicKeyHash, err)
 			}
 			err = cryptoVerifyPublicKeyHashSignature(sigPubKey, key, keyOp.signature)
 			if err != nil {
-				return 0, fmt.Errorf("Failed verification of key op for %s by %s", key, keyOp.signatureKeyHash)
+				return fmt.Errorf("Failed verification of key op for %s by %s", key, keyOp.signatureKeyHash)
 			}
 		}
-		// At this point, all required signatures have been verified
-		if keyOps[0].op == "A" {
+		dbpk, err := dbGetPublicKey(key)
+		switch keyOps[0].op {
+		case "A":
 			// Add the key to the list of valid signatories. But first, check if it already exists.
-			_, err := dbGetPublicKey(key)
 			if err == nil {
-				return 0, fmt.Errorf("Attempt to add an already existing key to the list of signatores")
+				return fmt.Errorf("Attempt to add an already existing key to the list of signatores")
 			}
-			dbWritePublicKey(keyOps[0].publicKeyBytes, key, thisBlockHeight)
-		} else if keyOps[0].op == "R" {
+		case "R":
 			// Revoke the key. But first, check if it's already revoked.
-			dbpk, err := dbGetPublicKey(key)
 			if err != nil {
-				return 0, fmt.Errorf("Cannot retrieve key to revoke: %s", key)
+				return fmt.Errorf("Cannot retrieve key to revoke: %s", key)
 			}
 			if dbpk.isRevoked {
-				return 0, fmt.Errorf("Attempt to revoke a key which is already revoked: %s", key)
+				return fmt.Errorf("Attempt to revoke a key which is already revoked: %s", key)
 			}
-			dbRevokePublicKey(key)
+		default:
+			return fmt.Errorf("Invalid key op: %s", keyOps[0].op)
+		}
+	}
+	// At this point, all required signatures have been verified
+	for key, keyOps := range allKeyOps {
+		if keyOps[0].op == "A" {
+			dbWritePublicKey(keyOps[0].publicKeyBytes, key, height)
 		} else {
-			return 0, fmt.Errorf("Invalid key op: %s", keyOps[0].op)
+			dbRevokePublicKey(key, height, timeAccepted)
 		}
 	}
-	// Everything's ok, the block is ok to import.
-	return thisBlockHeight, nil
+	return nil
+}
+
+// Checks and accepts the block in the given file into the blockchain: the block is copied
+// into the blockchain directory and recorded in the main database. Returns the new block.
+func blockchainImportBlockFile(fileName string, hashSignature []byte) (*Block, error) {
+	blk, err := OpenBlockFile(fileName)
+	if err != nil {
+		metricsBlocksRejected.Inc("unreadable")
+		return nil, fmt.Errorf("Error opening block file: %v", err)
+	}
+	defer func() {
+		if err := blk.Close(); err != nil {
+			log.Printf("blockchainImportBlockFile blk.Close: %v", err)
+		}
+	}()
+	blk.HashSignature = hashSignature
+	timeStarted := time.Now()
+	height, err := checkAcceptBlock(blk)
+	metricsBlockVerificationTime.ObserveSince(timeStarted)
+	if err != nil {
+		reason := "other"
+		if rerr, ok := err.(blockRejectedError); ok {
+			reason = rerr.reason
+		}
+		metricsBlocksRejected.Inc(reason)
+		return nil, err
+	}
+	blk.Height = height
+	blk.DbBlockchainBlock.TimeAccepted = time.Now()
+	err = blockchainCopyFile(fileName, height)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot copy block file: %v", err)
+	}
+	err = dbInsertBlock(blk.DbBlockchainBlock)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot insert block: %v", err)
+	}
+	return blk, nil
 }
 
 // QuorumForHeight calculates the required key op quorum for the given block height
@@ -547,6 +718,65 @@ func (b *Block) dbGetKeyOps() (map[string][]BlockKeyOp, error) {
 	return keyOps, nil
 }
 
+// Returns the rows of the given table in the block, as maps of column names to values
+func (b *Block) dbGetTableRows(table string, limit int, offset int) ([]map[string]interface{}, error) {
+	if !dbTableExists(b.db, table) {
+		return nil, fmt.Errorf("No table %s in block %d", table, b.Height)
+	}
+	query := fmt.Sprintf("SELECT * FROM %s LIMIT ? OFFSET ?", dbQuoteIdentifier(table))
+	rows, err := b.db.Query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		row, err := dbScanRowToMap(rows, cols)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// BlockTableInfo describes a table in a block
+type BlockTableInfo struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+}
+
+// Returns the tables in the block, with their row counts
+func (b *Block) dbGetTables() ([]BlockTableInfo, error) {
+	rows, err := b.db.Query("SELECT name FROM sqlite_master WHERE type='table' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	tables := []BlockTableInfo{}
+	for rows.Next() {
+		var ti BlockTableInfo
+		if err = rows.Scan(&ti.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, ti)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	for i := range tables {
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s", dbQuoteIdentifier(tables[i].Name))
+		if err = b.db.QueryRow(query).Scan(&tables[i].Rows); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
 // Ensures special metadata tables exist in a SQLite database
 func dbEnsureBlockchainTables(db *sql.DB) {
 	if !dbTableExists(db, "_meta") {
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a new key which isn't in the database, with its public key bytes and hash
+func testNewKey(t *testing.T) (*ecdsa.PrivateKey, []byte, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, publicKeyBytes, getPubKeyHash(publicKeyBytes)
+}
+
+// Returns a key op on the key with the given hash, signed by the given key
+func testKeyOp(t *testing.T, op string, keyHash string, publicKeyBytes []byte, signer *ecdsa.PrivateKey, signerHash string) BlockKeyOp {
+	t.Helper()
+	signature, err := cryptoSignPublicKeyHash(signer, keyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return BlockKeyOp{op: op, publicKeyHash: keyHash, publicKeyBytes: publicKeyBytes, signatureKeyHash: signerHash, signature: signature}
+}
+
+func TestBlockchainApplyKeyOps(t *testing.T) {
+	testDbInit(t)
+	signer, signerHash := testKey(t, 0)
+	otherSigner, otherSignerHash := testKey(t, 0)
+	revokedSigner, revokedSignerHash := testKey(t, 0)
+	dbRevokePublicKey(revokedSignerHash, 1, time.Now())
+	_, toRevokeHash := testKey(t, 0)
+	_, revokedHash := testKey(t, 0)
+	dbRevokePublicKey(revokedHash, 1, time.Now())
+	unknownSigner, _, unknownSignerHash := testNewKey(t)
+	_, newBytes, newHash := testNewKey(t)
+	_, pendingBytes, pendingHash := testNewKey(t)
+
+	forgedOp := testKeyOp(t, "A", newHash, newBytes, signer, signerHash)
+	forgedOp.signature, _ = cryptoSignPublicKeyHash(signer, pendingHash)
+	// The quorum grows with the height
+	highHeight := 1000
+	highQuorum := QuorumForHeight(highHeight)
+	if highQuorum < 2 {
+		t.Fatalf("expected a quorum of more than one key at height %d", highHeight)
+	}
+	repeatedOps := []BlockKeyOp{}
+	for i := 0; i < highQuorum; i++ {
+		repeatedOps = append(repeatedOps, testKeyOp(t, "A", newHash, newBytes, signer, signerHash))
+	}
+
+	tests := []struct {
+		name    string
+		keyOps  map[string][]BlockKeyOp
+		height  int
+		wantErr string
+	}{
+		{"quorum not met", map[string][]BlockKeyOp{newHash: {testKeyOp(t, "A", newHash, newBytes, signer, signerHash)}}, highHeight, "Quorum"},
+		{"same signer repeated", map[string][]BlockKeyOp{newHash: repeatedOps}, highHeight, "signed more than once"},
+		{"unknown signer", map[string][]BlockKeyOp{newHash: {testKeyOp(t, "A", newHash, newBytes, unknownSigner, unknownSignerHash)}}, 10, "signatory"},
+		{"revoked signer", map[string][]BlockKeyOp{newHash: {testKeyOp(t, "A", newHash, newBytes, revokedSigner, revokedSignerHash)}}, 10, "is revoked"},
+		{"signature of another key", map[string][]BlockKeyOp{newHash: {forgedOp}}, 10, "Failed verification"},
+		{"signed with another key", map[string][]BlockKeyOp{newHash: {testKeyOp(t, "A", newHash, newBytes, otherSigner, signerHash)}}, 10, "Failed verification"},
+		{"add existing key", map[string][]BlockKeyOp{signerHash: {testKeyOp(t, "A", signerHash, newBytes, otherSigner, otherSignerHash)}}, 10, "already existing"},
+		{"revoke unknown key", map[string][]BlockKeyOp{newHash: {testKeyOp(t, "R", newHash, nil, signer, signerHash)}}, 10, "Cannot retrieve"},
+		{"revoke revoked key", map[string][]BlockKeyOp{revokedHash: {testKeyOp(t, "R", revokedHash, nil, signer, signerHash)}}, 10, "already revoked"},
+		{"invalid op", map[string][]BlockKeyOp{newHash: {testKeyOp(t, "X", newHash, newBytes, signer, signerHash)}}, 10, "Invalid key op"},
+		{"one invalid op rejects all", map[string][]BlockKeyOp{
+			pendingHash: {testKeyOp(t, "A", pendingHash, pendingBytes, signer, signerHash)},
+			newHash:     {testKeyOp(t, "A", newHash, newBytes, revokedSigner, revokedSignerHash)},
+		}, 10, "is revoked"},
+		{"add and revoke", map[string][]BlockKeyOp{
+			newHash:      {testKeyOp(t, "A", newHash, newBytes, signer, signerHash)},
+			toRevokeHash: {testKeyOp(t, "R", toRevokeHash, nil, signer, signerHash), testKeyOp(t, "R", toRevokeHash, nil, otherSigner, otherSignerHash)},
+		}, 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := blockchainApplyKeyOps(tt.keyOps, tt.height, time.Now())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if dbPublicKeyExists(pendingHash) {
+		t.Error("a key was added by a rejected set of key ops")
+	}
+	added, err := dbGetPublicKey(newHash)
+	if err != nil {
+		t.Fatal("the added key is missing")
+	}
+	if added.addBlockHeight != 10 || added.isRevoked {
+		t.Errorf("the added key has height %d and revoked %v", added.addBlockHeight, added.isRevoked)
+	}
+	revoked, err := dbGetPublicKey(toRevokeHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked.isRevoked || revoked.revBlockHeight != 10 {
+		t.Errorf("the revoked key has revoked %v at height %d", revoked.isRevoked, revoked.revBlockHeight)
+	}
+}
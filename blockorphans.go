@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Orphan blocks are blocks whose previous block is not (yet) in the blockchain, usually because
+// blocks arrive out of order. They are kept in a subdirectory of the data directory, with their
+// metadata in the orphans table, and imported as soon as their previous block is accepted.
+
+const orphansSubdirectoryBaseName = "orphans"
+
+// The maximum number of orphan blocks kept; the oldest are discarded first
+const orphanMaxCount = 1024
+
+// The maximum number of orphan blocks kept from a single peer
+const orphanMaxPerPeer = 128
+
+// How long an orphan block is kept while waiting for its previous block
+const orphanMaxAge = 24 * time.Hour
+
+// Returns the filename under which the orphan block with the given hash is stored
+func orphanGetFilename(hash string) string {
+	return fmt.Sprintf("%s/%s/%s.db", cfg.DataDir, orphansSubdirectoryBaseName, hash)
+}
+
+// Adds the block in the given file to the orphan blocks. The file is moved into the orphans directory.
+// The source is the key hash of the peer which has sent the block.
+func orphanAdd(fileName string, hash string, hashSignature []byte, prevHash string, source string) error {
+	if dbCountOrphansFrom(source) >= orphanMaxPerPeer {
+		return fmt.Errorf("too many orphan blocks from %s", source)
+	}
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s", cfg.DataDir, orphansSubdirectoryBaseName), 0700); err != nil {
+		return err
+	}
+	orphanFileName := orphanGetFilename(hash)
+	if err := os.Rename(fileName, orphanFileName); err != nil {
+		// Probably a different filesystem
+		if err = copyFile(fileName, orphanFileName); err != nil {
+			return err
+		}
+		removeFile(fileName)
+	}
+	err := dbInsertOrphan(&DbOrphanBlock{
+		Hash:              hash,
+		PreviousBlockHash: prevHash,
+		HashSignature:     hashSignature,
+		TimeReceived:      time.Now(),
+		Source:            source,
+	})
+	if err != nil {
+		removeFile(orphanFileName)
+		return err
+	}
+	log.Println("Keeping orphan block", hash, "until its previous block", prevHash, "arrives")
+	orphanPrune()
+	return nil
+}
+
+// Removes an orphan block
+func orphanRemove(hash string) {
+	dbDeleteOrphan(hash)
+	if fileExists(orphanGetFilename(hash)) {
+		removeFile(orphanGetFilename(hash))
+	}
+}
+
+// Imports the orphan blocks which extend the block with the given hash, then the ones extending those,
+// and so on. Returns the blocks which have been accepted, in height order.
+func orphanConnect(parentHash string) []*Block {
+	var accepted []*Block
+	queue := []string{parentHash}
+	for len(queue) > 0 {
+		prevHash := queue[0]
+		queue = queue[1:]
+		for _, dbo := range dbGetOrphansByPrevHash(prevHash) {
+			blk, err := blockchainImportBlockFile(orphanGetFilename(dbo.Hash), dbo.HashSignature)
+			orphanRemove(dbo.Hash)
+			if err != nil {
+				log.Println("Cannot import orphan block", dbo.Hash, "from", dbo.Source, err)
+				continue
+			}
+			log.Println("Accepted orphan block", blk.Hash, "at height", blk.Height)
+			accepted = append(accepted, blk)
+			queue = append(queue, blk.Hash)
+		}
+	}
+	return accepted
+}
+
+// Discards expired orphan blocks, and the oldest ones if there are too many
+func orphanPrune() {
+	orphans := dbGetOrphans()
+	for i, dbo := range orphans {
+		if time.Since(dbo.TimeReceived) < orphanMaxAge && len(orphans)-i <= orphanMaxCount {
+			break
+		}
+		log.Println("Discarding orphan block", dbo.Hash)
+		orphanRemove(dbo.Hash)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -33,6 +38,84 @@ func blockWebSendBlock(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, blockFilename)
 }
 
+// The maximum number of table rows sent in one response
+const blockWebMaxTableRows = 1000
+
+// A table's rows from a block, together with the block's header which can be verified with the
+// chain's keys
+type blockWebTableRows struct {
+	Height                 int                      `json:"height"`
+	Hash                   string                   `json:"hash"`
+	HashSignature          string                   `json:"hash_signature"`
+	PreviousBlockHash      string                   `json:"prev_hash"`
+	SignaturePublicKeyHash string                   `json:"sigkey_hash"`
+	Table                  string                   `json:"table"`
+	Rows                   []map[string]interface{} `json:"rows"`
+}
+
+// Sends the rows of a table in the block at the given height as JSON. Light nodes fetch the block
+// from a peer if they don't have it. The limit and offset query parameters page through the rows.
+func blockWebSendBlockTable(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	blockHeight, err := strconv.Atoi(vars["height"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	limit := blockWebMaxTableRows
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > blockWebMaxTableRows {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	offset := 0
+	if s := r.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if !dbBlockHeightExists(blockHeight) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := lightOpenBlockByHeight(blockHeight)
+	if err != nil {
+		log.Println("Cannot open block", blockHeight, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			log.Printf("blockWebSendBlockTable b.Close: %v", err)
+		}
+	}()
+	rows, err := b.dbGetTableRows(vars["table"], limit, offset)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	log.Println("HTTP serving table", vars["table"], "of block", blockHeight, "to", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonifyWhateverToBytes(blockWebTableRows{
+		Height:                 b.Height,
+		Hash:                   b.Hash,
+		HashSignature:          hex.EncodeToString(b.HashSignature),
+		PreviousBlockHash:      b.PreviousBlockHash,
+		SignaturePublicKeyHash: b.SignaturePublicKeyHash,
+		Table:                  vars["table"],
+		Rows:                   rows,
+	}))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func blockWebSendChainParams(w http.ResponseWriter, r *http.Request) {
 	log.Println("HTTP serving chainparams.json to", r.RemoteAddr)
 
@@ -44,15 +127,90 @@ func blockWebSendChainParams(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Returns the URL at which a peer can download the block at the given height. The host is the
+// configured advertise address, or else the local address the peer has connected to.
+func blockWebGetBlockURL(localAddr net.Addr, height int) (string, error) {
+	host, port, err := blockWebAdvertisedHostPort(localAddr)
+	if err != nil {
+		return "", err
+	}
+	scheme := "http"
+	if httpTLSConfig != nil {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:   fmt.Sprintf("/block/%d", height),
+	}
+	return u.String(), nil
+}
+
+// Returns the host and port under which the HTTP server is reachable by peers
+func blockWebAdvertisedHostPort(localAddr net.Addr) (string, int, error) {
+	if cfg.AdvertiseAddress != "" {
+		host, portString, err := net.SplitHostPort(cfg.AdvertiseAddress)
+		if err != nil {
+			// No port, only the host (which might be a bare or bracketed IPv6 address)
+			return strings.Trim(cfg.AdvertiseAddress, "[]"), cfg.httpPort, nil
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid port in advertise address %s", cfg.AdvertiseAddress)
+		}
+		return host, port, nil
+	}
+	tcpAddr, ok := localAddr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.IsUnspecified() {
+		return "", 0, fmt.Errorf("cannot determine the local address from %v", localAddr)
+	}
+	host := tcpAddr.IP.String()
+	if tcpAddr.Zone != "" {
+		host += "%" + tcpAddr.Zone
+	}
+	return host, cfg.httpPort, nil
+}
+
+// The client used to download blocks from the URLs sent by peers. The peers' HTTPS certificates
+// are not verified: they are usually self-signed, and the downloaded blocks are verified anyway.
+// The downloads run in the connections' goroutines, so they must not take longer than the sync
+// manager waits for a block before asking another peer.
+var blockWebDownloadClient = &http.Client{
+	Timeout: syncRequestTimeout,
+	Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12},
+	},
+}
+
 func blockWebServer() {
 	r := mux.NewRouter()
+	// Public endpoints
 	r.HandleFunc("/block/{height}", blockWebSendBlock)
 	r.HandleFunc("/chainparams.json", blockWebSendChainParams)
+	r.HandleFunc("/healthz", healthzHandler)
+	r.HandleFunc("/readyz", readyzHandler)
+	// Protected endpoints
+	r.HandleFunc("/block/{height}/table/{table}", httpAuthProtect(blockWebSendBlockTable))
+	r.HandleFunc("/metrics", httpAuthProtect(metricsHandler))
+	webAPIRegister(r)
 
-	serverAddress := fmt.Sprintf(":%d", cfg.httpPort)
-
-	log.Println("HTTP listening on", serverAddress)
-	err := http.ListenAndServe(serverAddress, r)
+	server := http.Server{
+		Addr:      net.JoinHostPort(cfg.HttpAddress, strconv.Itoa(cfg.httpPort)),
+		Handler:   r,
+		TLSConfig: httpTLSConfig,
+	}
+	var err error
+	if httpTLSConfig != nil {
+		log.Println("HTTPS listening on", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		if httpAuthEnabled() {
+			log.Println("Warning: HTTP authentication is enabled without TLS, requests and responses are not encrypted")
+		}
+		log.Println("HTTP listening on", server.Addr)
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -31,7 +35,13 @@ func processActions() bool {
 		actionMyKeys()
 		return true
 	case "query":
-		actionQuery(flag.Arg(1))
+		actionQuery(flag.Args()[1:])
+		return true
+	case "reindex":
+		actionReindex()
+		return true
+	case "call":
+		actionCall(flag.Args()[1:])
 		return true
 	case "signimportblock":
 		if flag.NArg() < 2 {
@@ -63,6 +73,9 @@ func processPreBlockchainActions() bool {
 		}
 		actionPull(flag.Arg(1))
 		return true
+	case "status":
+		actionStatus()
+		return true
 	}
 	return false
 }
@@ -150,52 +163,213 @@ func actionSignImportBlock(fn string) {
 	}
 }
 
-// Runs a SQL query over all the blocks.
-func actionQuery(q string) {
-	log.Println("Running query:", q)
-	errCount := 0
-	for h := dbGetBlockchainHeight(); h > 0; h-- {
-		fn := blockchainGetFilename(h)
-		db, err := dbOpen(fn, true)
-		if err != nil {
-			log.Panic(err)
-		}
-		rows, err := db.Query(q)
-		if err != nil {
-			errCount++
-			continue
-		}
-		cols, err := rows.Columns()
-		if err != nil {
-			log.Panic(err)
+// Bound parameters of a query, given with repeated -param flags. Values which look like numbers
+// are passed as numbers, so they compare equal to numbers stored in the blocks.
+type queryArgs []interface{}
+
+func (a *queryArgs) String() string {
+	return fmt.Sprint(*a)
+}
+
+func (a *queryArgs) Set(s string) error {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*a = append(*a, i)
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		*a = append(*a, f)
+	} else {
+		*a = append(*a, s)
+	}
+	return nil
+}
+
+// Runs a SQL query over the blocks (by default, all except the genesis block) and prints the
+// result rows. By default the query is run once, with the tables of all the blocks combined and
+// an additional _height column. With -per-block, it's run separately on each block, and with
+// -index, on the index database. The arguments are the flags followed by the query.
+func actionQuery(cmdArgs []string) {
+	height := dbGetBlockchainHeight()
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	format := fs.String("format", queryFormatJSONLines, "Output format: "+strings.Join(queryFormats, ", "))
+	from := fs.Int("from", 1, "The lowest block height to query")
+	to := fs.Int("to", height, "The highest block height to query")
+	genesis := fs.Bool("genesis", false, "Include the genesis block (start from height 0)")
+	perBlock := fs.Bool("per-block", false, "Run the query separately on each block")
+	ascending := fs.Bool("asc", false, "With -per-block, query the blocks oldest first instead of newest first")
+	blockColumns := fs.Bool("block-columns", false, "With -per-block, add the _height and _hash columns of each row's block")
+	useIndex := fs.Bool("index", false, "Run the query on the index database")
+	var args queryArgs
+	fs.Var(&args, "param", "A bound parameter of the query (can be repeated)")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 1 {
+		log.Fatalln("Expecting 1 argument after the flags: SQL query")
+	}
+	q := fs.Arg(0)
+
+	fromSet := false
+	fs.Visit(func(f *flag.Flag) {
+		fromSet = fromSet || f.Name == "from"
+	})
+	if *genesis {
+		if fromSet && *from > 0 {
+			log.Fatalln("-genesis can't be used with -from greater than 0")
 		}
-		for rows.Next() {
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			for i := range columns {
-				columnPointers[i] = &columns[i]
-			}
-			if err := rows.Scan(columnPointers...); err != nil {
-				log.Panic(err)
-			}
-			row := make(map[string]interface{})
-			for i, colName := range cols {
-				val := columnPointers[i].(*interface{})
-				if reflect.TypeOf(*val).String() == "[]uint8" {
-					row[colName] = string((*val).([]byte))
-				} else {
-					row[colName] = *val
+		*from = 0
+	}
+	if *to > height {
+		*to = height
+	}
+	if *perBlock && *useIndex {
+		log.Fatalln("-per-block can't be used with -index")
+	}
+	if (*ascending || *blockColumns) && !*perBlock {
+		log.Fatalln("-asc and -block-columns can only be used with -per-block")
+	}
+	if *useIndex && indexGetDb() == nil {
+		log.Fatalln("The index database is not enabled (see the -index-tables flag)")
+	}
+	out, err := newQueryOutput(*format, os.Stdout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Println("Running query:", q)
+	ctx := context.Background()
+	callback := func(cols []string, row map[string]interface{}) error {
+		return out.Write(cols, row)
+	}
+	switch {
+	case *perBlock:
+		var errCount int
+		_, errCount, err = blockchainQuery(ctx, q, args, *from, *to, *ascending, func(height int, hash string, cols []string, row map[string]interface{}) error {
+			if *blockColumns {
+				for _, c := range []string{"_height", "_hash"} {
+					if inStrings(c, cols) {
+						return fmt.Errorf("the query returns a %s column, which -block-columns would replace", c)
+					}
 				}
+				cols = append([]string{"_height", "_hash"}, cols...)
+				row["_height"] = height
+				row["_hash"] = hash
 			}
-			buf, err := json.Marshal(row)
-			if err != nil {
-				log.Panic(err)
-			}
-			fmt.Println(string(buf))
+			return out.Write(cols, row)
+		})
+		if errCount != 0 {
+			log.Println("There have been", errCount, "errors.")
+		}
+	case *useIndex:
+		if err = indexUpdate(); err != nil {
+			log.Println("Error updating the index:", err)
 		}
+		_, err = indexQuery(ctx, q, args, *from, *to, callback)
+	default:
+		_, err = blockchainQueryUnified(ctx, q, args, *from, *to, callback)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatalln("Query failed:", err)
+	}
+}
+
+// Rebuilds the index database from scratch. The node shouldn't be running at the same time.
+func actionReindex() {
+	if indexGetDb() == nil {
+		log.Fatalln("The index database is not enabled (see the -index-tables flag)")
+	}
+	if err := indexReset(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Indexing", dbGetBlockchainHeight(), "blocks...")
+	if err := indexUpdate(); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Done.")
+}
+
+// Queries the readiness endpoint of the node running with the same configuration, and prints
+// its status. Exits with status 1 if the node isn't ready or can't be reached.
+func actionStatus() {
+	url := httpLocalBaseURL() + "/readyz"
+	resp, err := httpLocalClient(10 * time.Second).Get(url)
+	if err != nil {
+		fmt.Println("The node is not reachable at", url, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	var status healthStatus
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		log.Fatalln("Error decoding the status from", url, err)
+	}
+	state := "ready"
+	if !status.Healthy {
+		state = "unhealthy"
+	} else if !status.Ready {
+		state = "not ready"
+	}
+	fmt.Printf("%-18s %s\n", "Status:", state)
+	fmt.Printf("%-18s %v\n", "Verified:", status.Verified)
+	fmt.Printf("%-18s %d\n", "Height:", status.Height)
+	fmt.Printf("%-18s %d (at most %d blocks behind allowed)\n", "Agreed height:", status.AgreedHeight, status.MaxLag)
+	fmt.Printf("%-18s %d (%d required)\n", "Peers:", status.Peers, status.MinPeers)
+	for _, problem := range status.Problems {
+		fmt.Printf("%-18s %s\n", "Problem:", problem)
+	}
+	if !status.Ready {
+		os.Exit(1)
+	}
+}
+
+// Sends a HTTP request signed with one of my keys, and prints the response body. The URL can be
+// a path on the HTTP server of the node running with the same configuration. Exits with status 1
+// if the response status isn't 2xx.
+func actionCall(cmdArgs []string) {
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	method := fs.String("X", http.MethodGet, "The request method")
+	data := fs.String("d", "", "The request body")
+	insecure := fs.Bool("insecure", false, "Don't verify the server's TLS certificate")
+	timeout := fs.Duration("timeout", 30*time.Second, "The longest time the request may take, 0 for no limit (e.g. to stream /api/events)")
+	fs.Parse(cmdArgs)
+	if fs.NArg() != 1 {
+		log.Fatalln("Expecting 1 argument after the flags: URL or path")
+	}
+	url := fs.Arg(0)
+	client := &http.Client{Timeout: *timeout}
+	if strings.HasPrefix(url, "/") {
+		url = httpLocalBaseURL() + url
+		client = httpLocalClient(*timeout)
+	} else if *insecure {
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12},
+		}
+	}
+	var body io.Reader
+	if *data != "" {
+		body = strings.NewReader(*data)
+	}
+	req, err := http.NewRequest(*method, url, body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	privateKey, publicKeyHash, err := cryptoGetAPrivateKey()
+	if err != nil {
+		log.Fatalln("Cannot get a private key:", err)
+	}
+	if err = httpAuthSignRequest(req, privateKey, publicKeyHash); err != nil {
+		log.Fatalln("Cannot sign the request:", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+	if _, err = io.Copy(os.Stdout, resp.Body); err != nil {
+		log.Fatalln(err)
 	}
-	if errCount != 0 {
-		log.Println("There have been", errCount, "errors.")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Fprintln(os.Stderr, "HTTP status:", resp.Status)
+		os.Exit(1)
 	}
 }
 
@@ -205,8 +379,11 @@ func actionHelp() {
 	flag.PrintDefaults()
 	fmt.Println("Commands:")
 	fmt.Println("\thelp\t\tShows this help message")
+	fmt.Println("\tcall\t\tSends a HTTP request signed with one of my keys (expects flags and 1 argument: URL, or path on this node's HTTP server; see call -help)")
 	fmt.Println("\tmykeys\t\tShows a list of my public keys")
-	fmt.Println("\tquery\t\tExecutes a SQL query on the blockchain (expects 1 argument: SQL query)")
+	fmt.Println("\tquery\t\tExecutes a SQL query on the blockchain, with the tables of all the blocks combined (expects flags and 1 argument: SQL query; see query -help)")
+	fmt.Println("\treindex\t\tRebuilds the index database from scratch")
+	fmt.Println("\tstatus\t\tShows the health and sync status of the node running with the same configuration")
 	fmt.Println("\tsignimportblock\tSigns a block (creates metadata tables in it first) and imports it into the blockchain (expects 1 argument: a sqlite db filename)")
 	fmt.Println("\tnewchain\tStarts a new chain with the given parameters (expects 1 argument: chainparams.json)")
 	fmt.Println("\tpull\t\tPulls a blockchain from a HTTP URL (expects 1 argument: URL, e.g. http://example.com:2018/)")
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"strings"
 )
 
 // DefaultP2PPort is the default TCP port for p2p connections
@@ -16,6 +17,35 @@ const DefaultP2PPort = 2017
 // DefaultBlockWebServerPort is the default TCP port for the HTTP server
 const DefaultBlockWebServerPort = 2018
 
+// Default limits for p2p connections. Blocks larger than the chunk size are sent in chunks, so
+// the longest message only needs to fit a chunk.
+const (
+	DefaultP2PMaxLineSize    = 2 * 1024 * 1024  // the longest message
+	DefaultP2PMaxBlockSize   = 32 * 1024 * 1024 // the largest (uncompressed) block accepted from peers
+	DefaultP2PMsgRate        = 50               // messages per second
+	DefaultP2PMsgBurst       = 100
+	DefaultP2PQueueSize      = 5           // messages waiting to be processed, per peer
+	DefaultP2PChunkSize      = 1024 * 1024 // blocks larger than this are sent in chunks
+	DefaultP2PTargetOutbound = 8           // outgoing connections the node tries to keep
+	DefaultP2PMaxInbound     = 32          // incoming connections accepted
+)
+
+// The most memory which messages read from all the peers and waiting to be processed can take
+// (the queue size times the longest message, for each peer connection)
+const p2pMaxQueuedBytes = 1024 * 1024 * 1024
+
+// DefaultSyncQuorum is the default number of peers which must agree on a block hash before it's downloaded.
+// Peers are told apart by their TLS keys, which anyone can generate, so a larger quorum only helps
+// together with -p2p-require-chain-key.
+const DefaultSyncQuorum = 1
+
+// Defaults for the readiness check: the node is ready when it's connected to enough peers and
+// not too many blocks behind the best of them
+const (
+	DefaultReadyMinPeers = 1
+	DefaultReadyMaxLag   = 5
+)
+
 // DefaultConfigFile is the default configuration filename
 const DefaultConfigFile = "/etc/daisy/config.json"
 
@@ -23,13 +53,35 @@ const DefaultConfigFile = "/etc/daisy/config.json"
 const DefaultDataDir = ".daisy"
 
 var cfg struct {
-	configFile     string
-	P2pPort        int    `json:"p2p_port"`
-	DataDir        string `json:"data_dir"`
-	httpPort       int    `json:"http_port"`
-	showHelp       bool
-	faster         bool
-	p2pBlockInline bool
+	configFile         string
+	P2pPort            int    `json:"p2p_port"`
+	DataDir            string `json:"data_dir"`
+	httpPort           int    `json:"http_port"`
+	HttpAddress        string `json:"http_address"`
+	HttpTLSCert        string `json:"http_tls_cert"`
+	HttpTLSKey         string `json:"http_tls_key"`
+	HttpTLSClientCA    string `json:"http_tls_client_ca"`
+	HttpAuth           bool   `json:"http_auth"`
+	AdvertiseAddress   string `json:"advertise_address"`
+	showHelp           bool
+	faster             bool
+	p2pBlockInline     bool
+	p2pRequireChainKey bool
+	LanDiscovery       bool     `json:"lan_discovery"`
+	LanDiscoveryAddr   string   `json:"lan_discovery_address"`
+	Light              bool     `json:"light"`
+	IndexTables        []string `json:"index_tables"`
+	P2pMaxLineSize     int      `json:"p2p_max_line_size"`
+	P2pMaxBlockSize    int64    `json:"p2p_max_block_size"`
+	P2pMsgRate         float64  `json:"p2p_msg_rate"`
+	P2pMsgBurst        int      `json:"p2p_msg_burst"`
+	P2pQueueSize       int      `json:"p2p_queue_size"`
+	P2pChunkSize       int64    `json:"p2p_chunk_size"`
+	P2pTargetOutbound  int      `json:"p2p_target_outbound"`
+	P2pMaxInbound      int      `json:"p2p_max_inbound"`
+	SyncQuorum         int      `json:"sync_quorum"`
+	ReadyMinPeers      int      `json:"ready_min_peers"`
+	ReadyMaxLag        int      `json:"ready_max_lag"`
 }
 
 // Initialises defaults, parses command line
@@ -43,6 +95,18 @@ func configInit() {
 	// Init defaults
 	cfg.P2pPort = DefaultP2PPort
 	cfg.httpPort = DefaultBlockWebServerPort
+	cfg.P2pMaxLineSize = DefaultP2PMaxLineSize
+	cfg.P2pMaxBlockSize = DefaultP2PMaxBlockSize
+	cfg.P2pMsgRate = DefaultP2PMsgRate
+	cfg.P2pMsgBurst = DefaultP2PMsgBurst
+	cfg.P2pQueueSize = DefaultP2PQueueSize
+	cfg.P2pChunkSize = DefaultP2PChunkSize
+	cfg.LanDiscoveryAddr = DefaultLANDiscoveryAddress
+	cfg.P2pTargetOutbound = DefaultP2PTargetOutbound
+	cfg.P2pMaxInbound = DefaultP2PMaxInbound
+	cfg.SyncQuorum = DefaultSyncQuorum
+	cfg.ReadyMinPeers = DefaultReadyMinPeers
+	cfg.ReadyMaxLag = DefaultReadyMaxLag
 
 	// Config file is parsed first
 	for i, arg := range os.Args {
@@ -60,11 +124,30 @@ func configInit() {
 	// Then override the configuration with command-line flags
 	flag.IntVar(&cfg.P2pPort, "port", cfg.P2pPort, "P2P port")
 	flag.IntVar(&cfg.httpPort, "http-port", cfg.httpPort, "HTTP port")
+	flag.StringVar(&cfg.HttpAddress, "http-address", cfg.HttpAddress, "Address the HTTP server listens on (all interfaces if empty)")
+	flag.StringVar(&cfg.HttpTLSCert, "http-tls-cert", cfg.HttpTLSCert, "TLS certificate file (PEM) of the HTTP server, which then serves HTTPS")
+	flag.StringVar(&cfg.HttpTLSKey, "http-tls-key", cfg.HttpTLSKey, "TLS private key file (PEM) of the HTTP server")
+	flag.StringVar(&cfg.HttpTLSClientCA, "http-tls-client-ca", cfg.HttpTLSClientCA, "CA certificates file (PEM) of the HTTPS clients allowed to call protected endpoints")
+	flag.BoolVar(&cfg.HttpAuth, "http-auth", cfg.HttpAuth, "Only accept requests to protected HTTP endpoints which are signed with a chain key")
 	flag.StringVar(&cfg.DataDir, "dir", cfg.DataDir, "Data directory")
+	flag.StringVar(&cfg.AdvertiseAddress, "advertise-address", cfg.AdvertiseAddress, "Public host (or host:port) of the HTTP server, used in block URLs sent to peers")
 	flag.BoolVar(&cfg.showHelp, "help", false, "Shows CLI usage information")
 	flag.BoolVar(&cfg.faster, "faster", false, "Be faster when starting up")
 	flag.BoolVar(&cfg.p2pBlockInline, "p2pblockinline", false, "Send blocks to peers inline instead of over HTTP")
+	flag.IntVar(&cfg.SyncQuorum, "sync-quorum", cfg.SyncQuorum, "Number of peers which must agree on a block before it's downloaded (only resists fake peers with -p2p-require-chain-key)")
+	flag.BoolVar(&cfg.LanDiscovery, "lan-discovery", cfg.LanDiscovery, "Find peers on the local network with UDP multicast")
+	flag.BoolVar(&cfg.Light, "light", cfg.Light, "Light mode: only sync block headers and key ops, fetch blocks from peers when needed (recorded in the data directory)")
+	flag.BoolVar(&cfg.p2pRequireChainKey, "p2p-require-chain-key", false, "Only accept p2p peers which authenticate with a valid chain key")
+	flag.IntVar(&cfg.ReadyMinPeers, "ready-min-peers", cfg.ReadyMinPeers, "Number of connected peers required for the node to be ready")
+	flag.IntVar(&cfg.ReadyMaxLag, "ready-max-lag", cfg.ReadyMaxLag, "Number of blocks the node can be behind the height agreed on by the sync quorum and still be ready")
+	indexTables := flag.String("index-tables", strings.Join(cfg.IndexTables, ","), "Comma-separated list of block tables copied into the index database")
 	flag.Parse()
+	cfg.IndexTables = nil
+	for _, t := range strings.Split(*indexTables, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.IndexTables = append(cfg.IndexTables, t)
+		}
+	}
 
 	if cfg.showHelp {
 		actionHelp()
@@ -81,6 +164,28 @@ func configInit() {
 	if cfg.P2pPort < 1 || cfg.P2pPort > 65535 {
 		log.Fatal("Invalid TCP port", cfg.P2pPort)
 	}
+	if cfg.P2pChunkSize < 1024 || cfg.P2pChunkSize*4/3+1024 > int64(cfg.P2pMaxLineSize) {
+		log.Fatal("Invalid p2p chunk size", cfg.P2pChunkSize)
+	}
+	if cfg.P2pMaxLineSize < 1024 || cfg.P2pMaxBlockSize < 1024 || cfg.P2pMsgBurst < 1 || cfg.P2pQueueSize < 1 || cfg.SyncQuorum < 1 ||
+		cfg.P2pTargetOutbound < 0 || cfg.P2pMaxInbound < 0 {
+		log.Fatal("Invalid p2p limits")
+	}
+	if int64(cfg.P2pQueueSize)*int64(cfg.P2pMaxLineSize)*int64(cfg.P2pMaxInbound+cfg.P2pTargetOutbound) > p2pMaxQueuedBytes {
+		log.Fatalf("The p2p queue size, the longest message and the number of peers allow more than %d bytes of queued messages", p2pMaxQueuedBytes)
+	}
+	if cfg.SyncQuorum > 1 && !cfg.p2pRequireChainKey {
+		log.Println("WARNING: without -p2p-require-chain-key, a single node can pose as several peers and meet the sync quorum")
+	}
+	if cfg.ReadyMinPeers < 0 || cfg.ReadyMaxLag < 0 {
+		log.Fatal("Invalid readiness limits")
+	}
+	if (cfg.HttpTLSCert == "") != (cfg.HttpTLSKey == "") {
+		log.Fatal("The HTTP TLS certificate and key must be configured together")
+	}
+	if cfg.HttpTLSClientCA != "" && cfg.HttpTLSCert == "" {
+		log.Fatal("The HTTP TLS client CA requires a HTTP TLS certificate")
+	}
 }
 
 // Loads the JSON config file.
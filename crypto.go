@@ -5,12 +5,15 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"math/big"
+	"time"
 	"unsafe"
 )
 
@@ -219,6 +222,25 @@ func cryptoVerifyBytes(publicKey *ecdsa.PublicKey, hash []byte, signature []byte
 	return fmt.Errorf("Signature verification failed")
 }
 
+// Creates a self-signed certificate for the given keypair, valid for both server and client use
+func cryptoMakeSelfSignedCert(keypair *ecdsa.PrivateKey, publicKeyHash string) (tls.Certificate, error) {
+	serial := big.NewInt(randInt63())
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: publicKeyHash},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &keypair.PublicKey, keypair)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{certBytes}, PrivateKey: keypair}, nil
+}
+
 // Returns a random positive 63-bit integer
 func randInt63() int64 {
 	buf := make([]byte, 8)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -56,6 +57,7 @@ type DbPubKey struct {
 	isRevoked      bool              `json:"is_revoked"`
 	timeRevoked    time.Time         `json:"time_revoked"`
 	addBlockHeight int               `json:"block_height_added"`
+	revBlockHeight int               // -1 if not revoked
 	metadata       map[string]string `json:"metadata"`
 }
 
@@ -67,7 +69,8 @@ CREATE TABLE pubkeys (
 	time_added		INTEGER NOT NULL,
 	time_revoked	INTEGER,
 	block_height	INTEGER NOT NULL,
-	metadata		VARCHAR -- JSON
+	metadata		VARCHAR, -- JSON
+	revoked_block_height	INTEGER
 );`
 
 const privateTableCreate = `
@@ -89,10 +92,71 @@ const peersTableCreate = `
 CREATE TABLE peers (
 	address			VARCHAR NOT NULL PRIMARY KEY,	-- in the format "address:port", lowercase
 	time_added		INTEGER NOT NULL, -- time last seen
-	permanent		BOOLEAN NOT NULL DEFAULT 0
+	permanent		BOOLEAN NOT NULL DEFAULT 0,
+	pubkey_hash		VARCHAR, -- the key the peer has first authenticated with
+	source			VARCHAR NOT NULL DEFAULT '', -- where the address came from
+	success_count		INTEGER NOT NULL DEFAULT 0, -- successful outgoing connections
+	failure_count		INTEGER NOT NULL DEFAULT 0, -- failed outgoing connections
+	time_last_success	INTEGER, -- time of the last successful outgoing connection
+	time_last_attempt	INTEGER, -- time of the last outgoing connection attempt
+	latency_ms		INTEGER -- how long the last connection took to set up
 );
 `
 
+// Columns added to the peers table after it was first created, with their definitions
+var peersTableAddedColumns = []struct{ name, definition string }{
+	{"pubkey_hash", "VARCHAR"},
+	{"source", "VARCHAR NOT NULL DEFAULT ''"},
+	{"success_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"failure_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"time_last_success", "INTEGER"},
+	{"time_last_attempt", "INTEGER"},
+	{"latency_ms", "INTEGER"},
+}
+
+// DbPeer is the convenience structure holding information from the peers table
+type DbPeer struct {
+	Address         string
+	TimeLastSeen    time.Time
+	Permanent       bool
+	Source          string
+	SuccessCount    int
+	FailureCount    int
+	TimeLastSuccess time.Time // zero if never
+	TimeLastAttempt time.Time // zero if never
+	Latency         time.Duration
+}
+
+const bansTableCreate = `
+CREATE TABLE bans (
+	peer			VARCHAR NOT NULL PRIMARY KEY,	-- the key the peer authenticated with, or the host of a peer without a chain key
+	ban_count		INTEGER NOT NULL,	-- number of times the peer has been banned
+	time_banned		INTEGER NOT NULL,
+	banned_until	INTEGER NOT NULL,
+	reason			VARCHAR
+);
+`
+
+// DbOrphanBlock is the convenience structure holding information from the orphans table
+type DbOrphanBlock struct {
+	Hash              string
+	PreviousBlockHash string
+	HashSignature     []byte
+	TimeReceived      time.Time
+	Source            string
+}
+
+const orphansTableCreate = `
+CREATE TABLE orphans (
+	hash			VARCHAR NOT NULL PRIMARY KEY,
+	prev_hash		VARCHAR NOT NULL,
+	hash_signature	VARCHAR NOT NULL,
+	time_received	INTEGER NOT NULL,
+	source			VARCHAR -- key hash (formerly the address) of the peer the block came from
+);
+CREATE INDEX orphans_prev_hash ON orphans(prev_hash);
+`
+
 /*********************************************************************************************************************
  * Structures and SQL schema for the individual blockchain block tables.
  */
@@ -140,6 +204,12 @@ func dbInit() {
 			log.Panic(err)
 		}
 	}
+	if !dbColumnExists(mainDb, "pubkeys", "revoked_block_height") {
+		_, err = mainDb.Exec("ALTER TABLE pubkeys ADD COLUMN revoked_block_height INTEGER")
+		if err != nil {
+			log.Panic(err)
+		}
+	}
 	if !dbTableExists(mainDb, "config") {
 		_, err = mainDb.Exec(configTableCreate)
 		if err != nil {
@@ -152,7 +222,39 @@ func dbInit() {
 			log.Panic(err)
 		}
 		for peer := range bootstrapPeers {
-			_, err = mainDb.Exec("INSERT INTO peers(address, time_added, permanent) VALUES (?, ?, ?)", peer, getNowUTC(), true)
+			_, err = mainDb.Exec("INSERT INTO peers(address, time_added, permanent, source) VALUES (?, ?, ?, ?)", peer, getNowUTC(), true, p2pPeerSourceBootstrap)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+	if dbTableExists(mainDb, "bans") && dbColumnExists(mainDb, "bans", "pubkey_hash") {
+		if _, err = mainDb.Exec("ALTER TABLE bans RENAME COLUMN pubkey_hash TO peer"); err != nil {
+			log.Panic(err)
+		}
+	}
+	if dbTableExists(mainDb, "bans") && !dbColumnExists(mainDb, "bans", "peer") {
+		// Peers used to be banned by host, which banned all the nodes on the same host
+		log.Println("Dropping the bans by host")
+		if _, err = mainDb.Exec("DROP TABLE bans"); err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "bans") {
+		_, err = mainDb.Exec(bansTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "orphans") {
+		_, err = mainDb.Exec(orphansTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	for _, column := range peersTableAddedColumns {
+		if !dbColumnExists(mainDb, "peers", column.name) {
+			_, err = mainDb.Exec(fmt.Sprintf("ALTER TABLE peers ADD COLUMN %s %s", column.name, column.definition))
 			if err != nil {
 				log.Panic(err)
 			}
@@ -208,6 +310,39 @@ func dbTableExists(db *sql.DB, name string) bool {
 	return count > 0
 }
 
+// Checks to see if a column exists in the given table
+func dbColumnExists(db *sql.DB, table string, column string) bool {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&count)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return count > 0
+}
+
+// Quotes a table or column name for use in SQL
+func dbQuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Scans the current row into a map of column names to values. TEXT values are strings and
+// BLOB values are []byte (which encoding/json encodes as base64).
+func dbScanRowToMap(rows *sql.Rows, cols []string) (map[string]interface{}, error) {
+	columns := make([]interface{}, len(cols))
+	columnPointers := make([]interface{}, len(cols))
+	for i := range columns {
+		columnPointers[i] = &columns[i]
+	}
+	if err := rows.Scan(columnPointers...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{})
+	for i, colName := range cols {
+		row[colName] = columns[i]
+	}
+	return row, nil
+}
+
 // Panics if the system databases are not open
 func assertSysDbOpen() {
 	if mainDb == nil || privateDb == nil {
@@ -233,9 +368,11 @@ func dbWritePublicKey(pubkey []byte, hash string, blockHeight int) {
 	}
 }
 
-// Marks a public key as revoked.
-func dbRevokePublicKey(hash string) {
-	_, err := mainDb.Exec("UPDATE pubkeys SET time_revoked=? WHERE pubkey_hash=?", getNowUTC(), hash)
+// Marks a public key as revoked by the block at the given height, recording the block's timestamp
+// as the time of revocation.
+func dbRevokePublicKey(hash string, blockHeight int, timeRevoked time.Time) {
+	_, err := mainDb.Exec("UPDATE pubkeys SET state=?, time_revoked=?, revoked_block_height=? WHERE pubkey_hash=?",
+		"R", timeRevoked.UTC().Unix(), blockHeight, hash)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -328,8 +465,8 @@ func dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
 	var timeAdded int
 	var timeRevoked int
 	var metadata string
-	err := mainDb.QueryRow("SELECT pubkey_hash, pubkey, state, time_added, COALESCE(time_revoked, -1), COALESCE(metadata, ''), block_height FROM pubkeys WHERE pubkey_hash=?", publicKeyHash).Scan(
-		&dbpk.publicKeyHash, &publicKeyHexString, &dbpk.state, &timeAdded, &timeRevoked, &metadata, &dbpk.addBlockHeight)
+	err := mainDb.QueryRow("SELECT pubkey_hash, pubkey, state, time_added, COALESCE(time_revoked, -1), COALESCE(metadata, ''), block_height, COALESCE(revoked_block_height, -1) FROM pubkeys WHERE pubkey_hash=?", publicKeyHash).Scan(
+		&dbpk.publicKeyHash, &publicKeyHexString, &dbpk.state, &timeAdded, &timeRevoked, &metadata, &dbpk.addBlockHeight, &dbpk.revBlockHeight)
 	if err != nil && err != sql.ErrNoRows {
 		log.Panicln(err)
 	}
@@ -364,6 +501,71 @@ func dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
 	return &dbpk, nil
 }
 
+// Returns the number of public keys in the system databases
+func dbCountPublicKeys() int {
+	var count int
+	if err := mainDb.QueryRow("SELECT COUNT(*) FROM pubkeys").Scan(&count); err != nil {
+		log.Panic(err)
+	}
+	return count
+}
+
+// Returns a page of public key hashes, in the order the keys were added
+func dbGetPublicKeyHashes(limit int, offset int) []string {
+	rows, err := mainDb.Query("SELECT pubkey_hash FROM pubkeys ORDER BY block_height, pubkey_hash LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbGetPublicKeyHashes rows.Close: %v", err)
+		}
+	}()
+	result := []string{}
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			log.Panic(err)
+		}
+		result = append(result, hash)
+	}
+	return result
+}
+
+// A public key added or revoked by a block
+type DbKeyChange struct {
+	Height        int
+	PublicKeyHash string
+	Revoked       bool
+}
+
+// Returns the public keys added or revoked by the blocks in the range of heights, ordered by height,
+// with the added keys before the revoked ones
+func dbGetKeyChanges(minHeight int, maxHeight int) []DbKeyChange {
+	rows, err := mainDb.Query(`SELECT block_height, pubkey_hash, 0 FROM pubkeys WHERE block_height BETWEEN ? AND ?
+		UNION ALL SELECT revoked_block_height, pubkey_hash, 1 FROM pubkeys WHERE revoked_block_height BETWEEN ? AND ?
+		ORDER BY 1, 3, 2`, minHeight, maxHeight, minHeight, maxHeight)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbGetKeyChanges rows.Close: %v", err)
+		}
+	}()
+	result := []DbKeyChange{}
+	for rows.Next() {
+		var kc DbKeyChange
+		if err = rows.Scan(&kc.Height, &kc.PublicKeyHash, &kc.Revoked); err != nil {
+			log.Panic(err)
+		}
+		result = append(result, kc)
+	}
+	return result
+}
+
 // Returns a block hash by its height
 func dbGetBlockHashByHeight(height int) string {
 	var hash string
@@ -454,11 +656,17 @@ func dbBlockHeightExists(h int) bool {
 	return count > 0
 }
 
-// Inserts a block record into the main database, without validation
+// Inserts a block record into the main database, without validation, counts it in the
+// metrics and publishes the block-accepted event
 func dbInsertBlock(dbb *DbBlockchainBlock) error {
 	_, err := mainDb.Exec("INSERT INTO blockchain (hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
 		dbb.Hash, dbb.Height, dbb.PreviousBlockHash, dbb.SignaturePublicKeyHash, hex.EncodeToString(dbb.HashSignature), hex.EncodeToString(dbb.PreviousBlockHashSignature),
 		dbb.TimeAccepted.UTC().Unix(), dbb.Version)
+	if err == nil {
+		metricsBlocksAccepted.Inc()
+		accepted := *dbb
+		eventBus.Publish(busEventBlockAccepted, &accepted)
+	}
 	return err
 }
 
@@ -492,9 +700,220 @@ func dbGetSavedPeers() peerStringMap {
 	return result
 }
 
-// Saves a p2p peer address to the db
-func dbSavePeer(address string) {
-	_, err := mainDb.Exec("INSERT OR REPLACE INTO peers(address, time_added) VALUES (?, ?)", address, getNowUTC())
+// Saves a p2p peer address to the db, or refreshes its last seen time. Bootstrap peers are
+// permanent and never evicted from the address book.
+func dbSavePeer(address string, source string) {
+	_, err := mainDb.Exec(`INSERT INTO peers(address, time_added, permanent, source) VALUES (?, ?, ?, ?)
+		ON CONFLICT(address) DO UPDATE SET time_added=excluded.time_added, permanent=permanent OR excluded.permanent`,
+		address, getNowUTC(), source == p2pPeerSourceBootstrap, source)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Returns all the saved p2p peers, with their connection statistics
+func dbGetPeers() []DbPeer {
+	rows, err := mainDb.Query(`SELECT address, time_added, permanent, source, success_count, failure_count,
+		COALESCE(time_last_success, 0), COALESCE(time_last_attempt, 0), COALESCE(latency_ms, 0) FROM peers`)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbGetPeers rows.Close: %v", err)
+		}
+	}()
+	var result []DbPeer
+	for rows.Next() {
+		var dbp DbPeer
+		var timeAdded, timeLastSuccess, timeLastAttempt, latencyMs int
+		if err = rows.Scan(&dbp.Address, &timeAdded, &dbp.Permanent, &dbp.Source, &dbp.SuccessCount, &dbp.FailureCount,
+			&timeLastSuccess, &timeLastAttempt, &latencyMs); err != nil {
+			log.Println(err)
+			continue
+		}
+		dbp.TimeLastSeen = unixTimeStampToUTCTime(timeAdded)
+		if timeLastSuccess != 0 {
+			dbp.TimeLastSuccess = unixTimeStampToUTCTime(timeLastSuccess)
+		}
+		if timeLastAttempt != 0 {
+			dbp.TimeLastAttempt = unixTimeStampToUTCTime(timeLastAttempt)
+		}
+		dbp.Latency = time.Duration(latencyMs) * time.Millisecond
+		result = append(result, dbp)
+	}
+	return result
+}
+
+// Records a successful outgoing connection to the saved p2p peer address
+func dbRecordPeerSuccess(address string, latency time.Duration) {
+	now := getNowUTC()
+	_, err := mainDb.Exec(`UPDATE peers SET success_count=success_count+1, time_last_success=?, time_last_attempt=?,
+		time_added=?, latency_ms=? WHERE address=?`, now, now, now, latency.Milliseconds(), address)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Records a failed outgoing connection to the saved p2p peer address
+func dbRecordPeerFailure(address string) {
+	_, err := mainDb.Exec("UPDATE peers SET failure_count=failure_count+1, time_last_attempt=? WHERE address=?", getNowUTC(), address)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Deletes a saved p2p peer address
+func dbDeletePeer(address string) {
+	_, err := mainDb.Exec("DELETE FROM peers WHERE address=?", address)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Returns the value of the key in the config table, or an empty string
+func dbGetConfig(key string) string {
+	var value string
+	err := mainDb.QueryRow("SELECT value FROM config WHERE key=?", key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		log.Panic(err)
+	}
+	return value
+}
+
+// Sets the value of the key in the config table
+func dbSetConfig(key string, value string) {
+	_, err := mainDb.Exec("INSERT OR REPLACE INTO config(key, value) VALUES (?, ?)", key, value)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Returns the public key hash pinned for the saved p2p peer address, or an empty string
+func dbGetPeerKeyHash(address string) string {
+	var hash string
+	err := mainDb.QueryRow("SELECT COALESCE(pubkey_hash, '') FROM peers WHERE address=?", address).Scan(&hash)
+	if err != nil && err != sql.ErrNoRows {
+		log.Panic(err)
+	}
+	return hash
+}
+
+// Pins the public key hash to the saved p2p peer address, if it doesn't have one already
+func dbPinPeerKeyHash(address string, hash string) {
+	_, err := mainDb.Exec("UPDATE peers SET pubkey_hash=? WHERE address=? AND pubkey_hash IS NULL", hash, address)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Bans the peer (a key hash or a host), for a duration depending on how many times it has already
+// been banned. Returns the time the ban expires.
+func dbBanPeer(peer string, reason string) time.Time {
+	var banCount int
+	err := mainDb.QueryRow("SELECT ban_count FROM bans WHERE peer=?", peer).Scan(&banCount)
+	if err != nil && err != sql.ErrNoRows {
+		log.Panic(err)
+	}
+	banCount++
+	until := time.Now().Add(p2pBanDuration(banCount))
+	_, err = mainDb.Exec("INSERT OR REPLACE INTO bans(peer, ban_count, time_banned, banned_until, reason) VALUES (?, ?, ?, ?, ?)",
+		peer, banCount, getNowUTC(), until.UTC().Unix(), reason)
+	if err != nil {
+		log.Panic(err)
+	}
+	return until
+}
+
+// Tests if the peer (a key hash or a host) is currently banned
+func dbIsPeerBanned(peer string) bool {
+	var count int
+	err := mainDb.QueryRow("SELECT COUNT(*) FROM bans WHERE peer=? AND banned_until > ?", peer, getNowUTC()).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count > 0
+}
+
+// Records an orphan block, i.e. one whose previous block is not yet in the blockchain
+func dbInsertOrphan(dbo *DbOrphanBlock) error {
+	_, err := mainDb.Exec("INSERT OR REPLACE INTO orphans (hash, prev_hash, hash_signature, time_received, source) VALUES (?, ?, ?, ?, ?)",
+		dbo.Hash, dbo.PreviousBlockHash, hex.EncodeToString(dbo.HashSignature), dbo.TimeReceived.UTC().Unix(), dbo.Source)
+	return err
+}
+
+// Tests if an orphan block with the given hash exists in the db
+func dbOrphanExists(hash string) bool {
+	var count int
+	err := mainDb.QueryRow("SELECT COUNT(*) FROM orphans WHERE hash=?", hash).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count > 0
+}
+
+// Returns the orphan blocks matching the given WHERE clause, oldest first
+func dbGetOrphansWhere(where string, args ...interface{}) []DbOrphanBlock {
+	rows, err := mainDb.Query("SELECT hash, prev_hash, hash_signature, time_received, COALESCE(source, '') FROM orphans WHERE "+where+" ORDER BY time_received", args...)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbGetOrphansWhere rows.Close: %v", err)
+		}
+	}()
+	result := []DbOrphanBlock{}
+	for rows.Next() {
+		var dbo DbOrphanBlock
+		var hashSignatureHex string
+		var timeReceived int
+		if err = rows.Scan(&dbo.Hash, &dbo.PreviousBlockHash, &hashSignatureHex, &timeReceived, &dbo.Source); err != nil {
+			log.Panic(err)
+		}
+		if dbo.HashSignature, err = hex.DecodeString(hashSignatureHex); err != nil {
+			log.Println("Orphan block", dbo.Hash, "has an invalid hash signature:", err)
+			continue
+		}
+		dbo.TimeReceived = unixTimeStampToUTCTime(timeReceived)
+		result = append(result, dbo)
+	}
+	return result
+}
+
+// Returns the orphan blocks whose previous block is the given one
+func dbGetOrphansByPrevHash(prevHash string) []DbOrphanBlock {
+	return dbGetOrphansWhere("prev_hash=?", prevHash)
+}
+
+// Returns the number of orphan blocks
+func dbCountOrphans() int {
+	var count int
+	if err := mainDb.QueryRow("SELECT COUNT(*) FROM orphans").Scan(&count); err != nil {
+		log.Panic(err)
+	}
+	return count
+}
+
+// Returns the number of orphan blocks received from the given source
+func dbCountOrphansFrom(source string) int {
+	var count int
+	if err := mainDb.QueryRow("SELECT COUNT(*) FROM orphans WHERE source=?", source).Scan(&count); err != nil {
+		log.Panic(err)
+	}
+	return count
+}
+
+// Returns all the orphan blocks, oldest first
+func dbGetOrphans() []DbOrphanBlock {
+	return dbGetOrphansWhere("1=1")
+}
+
+// Deletes an orphan block record
+func dbDeleteOrphan(hash string) {
+	_, err := mainDb.Exec("DELETE FROM orphans WHERE hash=?", hash)
 	if err != nil {
 		log.Panic(err)
 	}
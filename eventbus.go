@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+)
+
+// The event bus passes internal events from the code where they happen to any number of
+// subscribers, each of which receives them on its own buffered channel. Publishing never blocks:
+// if a subscriber's channel is full, the event is dropped for that subscriber, so subscribers
+// must tolerate missing events (e.g. by also polling the state they're interested in).
+
+// Types of events published on the bus
+const (
+	busEventBlockAccepted    = "block_accepted"    // payload: *DbBlockchainBlock
+	busEventPeerConnected    = "peer_connected"    // payload: busPeerEvent
+	busEventPeerDisconnected = "peer_disconnected" // payload: busPeerEvent
+)
+
+// The payload of the peer events
+type busPeerEvent struct {
+	address  string
+	outbound bool
+}
+
+type busEvent struct {
+	eventType string
+	payload   interface{}
+}
+
+type eventBusType struct {
+	subscribers map[string][]chan busEvent
+	lock        WithMutex
+}
+
+var eventBus = eventBusType{subscribers: make(map[string][]chan busEvent)}
+
+// Subscribe returns a channel on which the events of the given type are received
+func (eb *eventBusType) Subscribe(eventType string, bufferSize int) chan busEvent {
+	ch := make(chan busEvent, bufferSize)
+	eb.lock.With(func() {
+		eb.subscribers[eventType] = append(eb.subscribers[eventType], ch)
+	})
+	return ch
+}
+
+// Unsubscribe stops delivering events to the channel
+func (eb *eventBusType) Unsubscribe(ch chan busEvent) {
+	eb.lock.With(func() {
+		for eventType, subs := range eb.subscribers {
+			for i, sub := range subs {
+				if sub == ch {
+					eb.subscribers[eventType] = append(subs[:i:i], subs[i+1:]...)
+					break
+				}
+			}
+		}
+	})
+}
+
+// Publish delivers the event to all the subscribers which have room for it
+func (eb *eventBusType) Publish(eventType string, payload interface{}) {
+	ev := busEvent{eventType: eventType, payload: payload}
+	eb.lock.With(func() {
+		for _, ch := range eb.subscribers[eventType] {
+			select {
+			case ch <- ev:
+			default:
+				log.Println("Event bus subscriber is full, dropping", eventType, "event")
+			}
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// /healthz reports whether the node is alive and its databases are usable, and /readyz whether
+// it's also usable by clients: the blockchain has been verified at startup, the node is connected
+// to enough peers (cfg.ReadyMinPeers), and it's no more than cfg.ReadyMaxLag blocks behind the
+// height the sync quorum agrees on. The heights peers report in hello messages aren't verified, so
+// a single peer could otherwise keep the node from ever being ready. Both return the same JSON
+// status, with HTTP status 200 if the check passes and 503 otherwise.
+
+// The status reported by the health and readiness endpoints
+type healthStatus struct {
+	Healthy      bool     `json:"healthy"`
+	Ready        bool     `json:"ready"`
+	Verified     bool     `json:"verified"`
+	Height       int      `json:"height"`
+	AgreedHeight int      `json:"agreed_height"`
+	Peers        int      `json:"peers"`
+	MinPeers     int      `json:"min_peers"`
+	MaxLag       int      `json:"max_lag"`
+	Problems     []string `json:"problems"`
+}
+
+// Checks the node's health and readiness
+func healthGetStatus() healthStatus {
+	status := healthStatus{
+		Healthy:  true,
+		Verified: blockchainVerified,
+		Height:   -1,
+		MinPeers: cfg.ReadyMinPeers,
+		MaxLag:   cfg.ReadyMaxLag,
+		Problems: []string{},
+	}
+	databases := []struct {
+		name string
+		db   *sql.DB
+	}{{"main", mainDb}, {"private", privateDb}, {"index", indexGetDb()}}
+	for _, d := range databases {
+		if d.db == nil {
+			// The index database is optional
+			if d.name != "index" {
+				status.Healthy = false
+				status.Problems = append(status.Problems, fmt.Sprintf("%s database: not open", d.name))
+			}
+			continue
+		}
+		if err := d.db.Ping(); err != nil {
+			status.Healthy = false
+			status.Problems = append(status.Problems, fmt.Sprintf("%s database: %v", d.name, err))
+		}
+	}
+	if !status.Healthy {
+		return status
+	}
+
+	status.Height = dbGetBlockchainHeight()
+	status.Peers, _ = p2pPeers.SyncStatus()
+	status.AgreedHeight = syncGetAgreedHeight()
+	status.Ready = true
+	if !status.Verified {
+		status.Ready = false
+		status.Problems = append(status.Problems, "the blockchain hasn't been verified yet")
+	}
+	if status.Peers < status.MinPeers {
+		status.Ready = false
+		status.Problems = append(status.Problems, fmt.Sprintf("connected to %d peers, %d required", status.Peers, status.MinPeers))
+	}
+	if lag := status.AgreedHeight - status.Height; lag > status.MaxLag {
+		status.Ready = false
+		status.Problems = append(status.Problems, fmt.Sprintf("%d blocks behind the height agreed on by the peers, at most %d allowed", lag, status.MaxLag))
+	}
+	return status
+}
+
+// /healthz: the node is alive and its databases are usable
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthGetStatus()
+	code := http.StatusOK
+	if !status.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	webAPIWriteStatus(w, code, status)
+}
+
+// /readyz: the node is healthy, verified, connected and in sync
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthGetStatus()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	webAPIWriteStatus(w, code, status)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The HTTP server uses TLS when a certificate and key are configured (http_tls_cert and
+// http_tls_key), and can also ask clients for certificates issued by a CA (http_tls_client_ca).
+// Block downloads, the chain parameters and the health checks are always public, so that peers
+// and load balancers can use them, while the other endpoints (the API, table rows and metrics) are
+// protected when http_auth is enabled or a client CA is configured. A request to a protected
+// endpoint is accepted if it comes with a client certificate verified against the client CA, or if
+// it is signed with a key which is in the blockchain and not revoked, i.e. by a registered device
+// or gateway. A signed request has these headers:
+//
+//	X-Daisy-Key:       the public key hash, in the "type:hex" format
+//	X-Daisy-Timestamp: the Unix time at which the request was signed
+//	X-Daisy-Nonce:     a random string of up to 64 characters, unique for each request
+//	X-Daisy-Signature: the hex-encoded signature of the SHA-256 hash of method + "\n" +
+//	                   request URI + "\n" + timestamp + "\n" + nonce + "\n" + hex SHA-256 of the body
+//
+// The timestamp must be within httpAuthMaxClockSkew of the node's clock, and each signed request is
+// accepted only once. The nonce lets identical requests be made within the same second.
+
+const (
+	httpAuthHeaderKey       = "X-Daisy-Key"
+	httpAuthHeaderTimestamp = "X-Daisy-Timestamp"
+	httpAuthHeaderNonce     = "X-Daisy-Nonce"
+	httpAuthHeaderSignature = "X-Daisy-Signature"
+)
+
+// How far the timestamp of a signed request may be from the node's clock
+const httpAuthMaxClockSkew = 5 * time.Minute
+
+// The largest request body which is read to check the signature
+const httpAuthMaxBodySize = 1024 * 1024
+
+// The longest nonce of a signed request
+const httpAuthMaxNonceLength = 64
+
+// The TLS configuration of the HTTP server, nil if it serves plain HTTP
+var httpTLSConfig *tls.Config
+
+// The keys and hashes of the accepted signed requests, with the times after which they can be
+// forgotten because their timestamps are too old to be accepted again
+var httpAuthSeenRequests = struct {
+	requests map[string]time.Time
+	lock     WithMutex
+}{requests: make(map[string]time.Time)}
+
+// Loads the HTTP server's certificate and the client CA, if configured
+func httpTLSInit() {
+	if cfg.HttpTLSCert == "" {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.HttpTLSCert, cfg.HttpTLSKey)
+	if err != nil {
+		log.Fatalln("Cannot load the HTTP TLS certificate:", err)
+	}
+	httpTLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.HttpTLSClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.HttpTLSClientCA)
+		if err != nil {
+			log.Fatalln("Cannot read the HTTP TLS client CA:", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalln("No certificates found in the HTTP TLS client CA file", cfg.HttpTLSClientCA)
+		}
+		httpTLSConfig.ClientCAs = pool
+		// Public endpoints must work without a client certificate
+		httpTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// Returns true if the protected endpoints require authentication
+func httpAuthEnabled() bool {
+	return cfg.HttpAuth || cfg.HttpTLSClientCA != ""
+}
+
+// Wraps the handler of a protected endpoint so that it's only called for authenticated requests
+func httpAuthProtect(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !httpAuthEnabled() || httpAuthHasClientCert(r) {
+			h(w, r)
+			return
+		}
+		if _, err := httpAuthVerifyRequest(r); err != nil {
+			log.Println("HTTP rejected", r.Method, r.URL.Path, "from", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "DaisySignature")
+			webAPIError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Returns true if the client presented a certificate which was verified against the client CA
+func httpAuthHasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) != 0
+}
+
+// Returns the hash which is signed for a request with the given timestamp, nonce and body hash
+func httpAuthRequestHash(method string, requestURI string, timestamp string, nonce string, bodyHash []byte) []byte {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n%s\n%s", method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash))))
+	return hash[:]
+}
+
+// Checks the signature of a request and returns the public key hash it was signed with. The body
+// is read and replaced, so the handler can still read it.
+func httpAuthVerifyRequest(r *http.Request) (string, error) {
+	keyHash := r.Header.Get(httpAuthHeaderKey)
+	timestamp := r.Header.Get(httpAuthHeaderTimestamp)
+	nonce := r.Header.Get(httpAuthHeaderNonce)
+	signatureHex := r.Header.Get(httpAuthHeaderSignature)
+	if keyHash == "" || timestamp == "" || nonce == "" || signatureHex == "" {
+		return "", errors.New("the request is not signed")
+	}
+	if len(nonce) > httpAuthMaxNonceLength {
+		return "", errors.New("the nonce is too long")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid timestamp")
+	}
+	signedAt := time.Unix(ts, 0)
+	if skew := time.Since(signedAt); skew > httpAuthMaxClockSkew || skew < -httpAuthMaxClockSkew {
+		return "", fmt.Errorf("the timestamp is more than %v away from the node's time", httpAuthMaxClockSkew)
+	}
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return "", errors.New("invalid signature encoding")
+	}
+
+	// The creator's key is in the genesis block, but on the node which created the chain it was
+	// added before the genesis block, without a height
+	dbpk, err := dbGetPublicKey(keyHash)
+	if err != nil || (dbpk.addBlockHeight < 0 && keyHash != chainParams.CreatorPublicKey) {
+		return "", fmt.Errorf("key %s is not a chain key", keyHash)
+	}
+	if dbpk.isRevoked {
+		return "", fmt.Errorf("key %s is revoked", keyHash)
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode key %s: %v", keyHash, err)
+	}
+
+	body := []byte{}
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, httpAuthMaxBodySize+1))
+		if err != nil {
+			return "", fmt.Errorf("cannot read the request body: %v", err)
+		}
+		if len(body) > httpAuthMaxBodySize {
+			return "", errors.New("the request body is too large")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	requestHash := httpAuthRequestHash(r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash[:])
+	if err = cryptoVerifyBytes(publicKey, requestHash, signature); err != nil {
+		return "", fmt.Errorf("invalid signature by key %s", keyHash)
+	}
+
+	// ECDSA signatures can be altered and remain valid, so the signed request is remembered
+	seen := keyHash + " " + hex.EncodeToString(requestHash)
+	replayed := false
+	httpAuthSeenRequests.lock.With(func() {
+		now := time.Now()
+		for req, expires := range httpAuthSeenRequests.requests {
+			if now.After(expires) {
+				delete(httpAuthSeenRequests.requests, req)
+			}
+		}
+		if _, ok := httpAuthSeenRequests.requests[seen]; ok {
+			replayed = true
+			return
+		}
+		httpAuthSeenRequests.requests[seen] = signedAt.Add(httpAuthMaxClockSkew)
+	})
+	if replayed {
+		return "", errors.New("the request has already been received")
+	}
+	return keyHash, nil
+}
+
+// Signs the request with the given private key. The body (if any) is read and replaced.
+func httpAuthSignRequest(req *http.Request, privateKey *ecdsa.PrivateKey, publicKeyHash string) error {
+	body := []byte{}
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	signature, err := cryptoSignBytes(privateKey, httpAuthRequestHash(req.Method, req.URL.RequestURI(), timestamp, nonce, bodyHash[:]))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(httpAuthHeaderKey, publicKeyHash)
+	req.Header.Set(httpAuthHeaderTimestamp, timestamp)
+	req.Header.Set(httpAuthHeaderNonce, nonce)
+	req.Header.Set(httpAuthHeaderSignature, hex.EncodeToString(signature))
+	return nil
+}
+
+// Returns the base URL of the HTTP server of the node running with the same configuration
+func httpLocalBaseURL() string {
+	scheme := "http"
+	if httpTLSConfig != nil {
+		scheme = "https"
+	}
+	host := "127.0.0.1"
+	if ip := net.ParseIP(cfg.HttpAddress); ip != nil && !ip.IsUnspecified() {
+		host = ip.String()
+	} else if ip == nil && cfg.HttpAddress != "" {
+		host = cfg.HttpAddress
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(cfg.httpPort)))
+}
+
+// Returns a HTTP client for the node running with the same configuration. With TLS, the server
+// must present the configured certificate (whatever host name it's issued for).
+func httpLocalClient(timeout time.Duration) *http.Client {
+	client := http.Client{Timeout: timeout}
+	if httpTLSConfig != nil {
+		myCert := httpTLSConfig.Certificates[0].Certificate[0]
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// The certificate is compared with the configured one instead
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], myCert) {
+						return errors.New("the server's certificate is not the configured HTTP certificate")
+					}
+					return nil
+				},
+				MinVersion: tls.VersionTLS12,
+			},
+		}
+	}
+	return &client
+}
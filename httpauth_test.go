@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a request signed with the given key, timestamp and nonce
+func testSignedRequest(t *testing.T, key *ecdsa.PrivateKey, keyHash string, signedAt time.Time, nonce string, body string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/call?method=test", strings.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	bodyHash := sha256.Sum256([]byte(body))
+	signature, err := cryptoSignBytes(key, httpAuthRequestHash(r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(httpAuthHeaderKey, keyHash)
+	r.Header.Set(httpAuthHeaderTimestamp, timestamp)
+	r.Header.Set(httpAuthHeaderNonce, nonce)
+	r.Header.Set(httpAuthHeaderSignature, hex.EncodeToString(signature))
+	return r
+}
+
+func TestHttpAuthVerifyRequest(t *testing.T) {
+	testDbInit(t)
+	key, keyHash := testKey(t, 1)
+	revokedKey, revokedKeyHash := testKey(t, 1)
+	dbRevokePublicKey(revokedKeyHash, 2, time.Now())
+	pendingKey, pendingKeyHash := testKey(t, -1)
+	unknownKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	replayed := testSignedRequest(t, key, keyHash, now, "replayed", "{}")
+	if _, err := httpAuthVerifyRequest(replayed); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	tampered := testSignedRequest(t, key, keyHash, now, "tampered", "{}")
+	tampered.Body = http.NoBody
+	unsigned := httptest.NewRequest("GET", "/api/call", nil)
+	longNonce := testSignedRequest(t, key, keyHash, now, strings.Repeat("n", httpAuthMaxNonceLength+1), "")
+
+	tests := []struct {
+		name    string
+		req     *http.Request
+		wantErr string
+	}{
+		{"good signature", testSignedRequest(t, key, keyHash, now, "good", "{}"), ""},
+		{"same request with another nonce", testSignedRequest(t, key, keyHash, now, "other", "{}"), ""},
+		{"replay", replayed, "already been received"},
+		{"clock behind", testSignedRequest(t, key, keyHash, now.Add(-2*httpAuthMaxClockSkew), "behind", "{}"), "away from the node's time"},
+		{"clock ahead", testSignedRequest(t, key, keyHash, now.Add(2*httpAuthMaxClockSkew), "ahead", "{}"), "away from the node's time"},
+		{"revoked key", testSignedRequest(t, revokedKey, revokedKeyHash, now, "revoked", "{}"), "is revoked"},
+		{"key without a height", testSignedRequest(t, pendingKey, pendingKeyHash, now, "pending", "{}"), "not a chain key"},
+		{"unknown key", testSignedRequest(t, unknownKey, cryptoMustGetPublicKeyHash(&unknownKey.PublicKey), now, "unknown", "{}"), "not a chain key"},
+		{"signed by another key", testSignedRequest(t, unknownKey, keyHash, now, "other key", "{}"), "invalid signature"},
+		{"tampered body", tampered, "invalid signature"},
+		{"unsigned", unsigned, "not signed"},
+		{"long nonce", longNonce, "nonce is too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotKeyHash, err := httpAuthVerifyRequest(tt.req)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if gotKeyHash != keyHash {
+					t.Errorf("got key %s, want %s", gotKeyHash, keyHash)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
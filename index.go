@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The index database is an optional database in the data directory into which the rows of the
+// configured tables (the index_tables setting) are copied from each block as it is accepted. Each
+// indexed table has all the columns found in any block, plus the _height and _hash of the block
+// the row comes from, and the _blocks table has the _height and _hash of each indexed block, so
+// the same queries work on the index as with the unified query engine, without opening the block
+// files. The index is kept up to date by a goroutine which follows the block-accepted events, and
+// can be rebuilt from scratch with the reindex command.
+
+const indexDbFileName = "index.db"
+
+const indexBlocksTableCreate = `
+CREATE TABLE _blocks (
+	_height		INTEGER NOT NULL PRIMARY KEY,
+	_hash		VARCHAR NOT NULL
+);`
+
+const indexMetaTableCreate = `
+CREATE TABLE _meta (
+	key		VARCHAR NOT NULL PRIMARY KEY,
+	value	VARCHAR
+);`
+
+// How often the index is checked against the blockchain, in case block-accepted events were dropped
+const indexCheckInterval = 1 * time.Minute
+
+// The index database, nil if it's not enabled. It's replaced when the index is rebuilt, while
+// the HTTP handlers and health checks use it.
+var indexDb = struct {
+	db   *sql.DB
+	lock WithMutex
+}{}
+
+// Returns the index database, or nil if it's not enabled
+func indexGetDb() *sql.DB {
+	var db *sql.DB
+	indexDb.lock.With(func() {
+		db = indexDb.db
+	})
+	return db
+}
+
+// Replaces the index database
+func indexSetDb(db *sql.DB) {
+	indexDb.lock.With(func() {
+		indexDb.db = db
+	})
+}
+
+func indexGetFilename() string {
+	return fmt.Sprintf("%s/%s", cfg.DataDir, indexDbFileName)
+}
+
+// Opens the index database, creating it if needed. If the configured tables have changed since
+// the index was built, it is rebuilt from scratch.
+func indexInit() {
+	if len(cfg.IndexTables) == 0 {
+		return
+	}
+	if cfg.Light {
+		log.Println("Light nodes don't store blocks, the index database is disabled")
+		return
+	}
+	for _, t := range cfg.IndexTables {
+		if t == "" || strings.HasPrefix(t, "_") {
+			log.Fatal("Invalid index table name: ", strconv.Quote(t))
+		}
+	}
+	if err := indexOpen(); err != nil {
+		log.Panic(err)
+	}
+	tables := strings.Join(cfg.IndexTables, ",")
+	var indexedTables string
+	err := indexGetDb().QueryRow("SELECT value FROM _meta WHERE key='tables'").Scan(&indexedTables)
+	if err != nil && err != sql.ErrNoRows {
+		log.Panic(err)
+	}
+	if err == nil && indexedTables != tables {
+		log.Println("The indexed tables have changed from", indexedTables, "to", tables, "- rebuilding the index")
+		if err = indexReset(); err != nil {
+			log.Panic(err)
+		}
+	}
+	if _, err = indexGetDb().Exec("INSERT OR REPLACE INTO _meta (key, value) VALUES ('tables', ?)", tables); err != nil {
+		log.Panic(err)
+	}
+}
+
+// Opens the index database and creates its system tables
+func indexOpen() error {
+	db, err := dbOpen(indexGetFilename(), false)
+	if err != nil {
+		return err
+	}
+	// Queries read the index while it's being written to
+	if _, err = db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return err
+	}
+	if !dbTableExists(db, "_blocks") {
+		if _, err = db.Exec(indexBlocksTableCreate); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if !dbTableExists(db, "_meta") {
+		if _, err = db.Exec(indexMetaTableCreate); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	indexSetDb(db)
+	return nil
+}
+
+// Deletes the index database and creates an empty one
+func indexReset() error {
+	if db := indexGetDb(); db != nil {
+		indexSetDb(nil)
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(indexGetFilename() + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := indexOpen(); err != nil {
+		return err
+	}
+	_, err := indexGetDb().Exec("INSERT OR REPLACE INTO _meta (key, value) VALUES ('tables', ?)", strings.Join(cfg.IndexTables, ","))
+	return err
+}
+
+// Follows the block-accepted events and indexes the new blocks
+func indexRun() {
+	blockEvents := eventBus.Subscribe(busEventBlockAccepted, 64)
+	defer eventBus.Unsubscribe(blockEvents)
+	ticker := time.NewTicker(indexCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := indexUpdate(); err != nil {
+			log.Println("Error updating the index:", err)
+		}
+		select {
+		case <-blockEvents:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Indexes the blocks which have been accepted since the last indexed block, starting with the
+// genesis block. If the last indexed block isn't in the blockchain, the index is rebuilt from scratch.
+func indexUpdate() error {
+	lastHeight := -1
+	var lastHash string
+	err := indexGetDb().QueryRow("SELECT _height, _hash FROM _blocks ORDER BY _height DESC LIMIT 1").Scan(&lastHeight, &lastHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && dbGetBlockHashByHeight(lastHeight) != lastHash {
+		log.Println("Indexed block", lastHash, "at height", lastHeight, "is not in the blockchain - rebuilding the index")
+		if err = indexReset(); err != nil {
+			return err
+		}
+		lastHeight = -1
+	}
+	height := dbGetBlockchainHeight()
+	for h := lastHeight + 1; h <= height; h++ {
+		hash := dbGetBlockHashByHeight(h)
+		if hash == "" {
+			return fmt.Errorf("no block at height %d", h)
+		}
+		if err = indexBlock(h, hash); err != nil {
+			return fmt.Errorf("block %d: %v", h, err)
+		}
+	}
+	return nil
+}
+
+// Copies the rows of the configured tables from the block into the index
+func indexBlock(height int, hash string) error {
+	ctx := context.Background()
+	tables, err := queryCollectTables(ctx, []int{height})
+	if err != nil {
+		return err
+	}
+	// Attached databases belong to a single connection
+	conn, err := indexGetDb().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, t := range tables {
+		if inStrings(t.name, cfg.IndexTables) {
+			if err = indexEnsureTable(ctx, conn, t); err != nil {
+				return err
+			}
+		}
+	}
+	if err = queryAttachBatch(ctx, conn, []int{height}); err != nil {
+		return err
+	}
+	defer func() {
+		if err := queryDetachBatch(ctx, conn, []int{height}); err != nil {
+			log.Println("indexBlock queryDetachBatch:", err)
+		}
+	}()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if !inStrings(t.name, cfg.IndexTables) {
+			continue
+		}
+		columns := []string{"_height", "_hash"}
+		for _, c := range t.columns {
+			columns = append(columns, dbQuoteIdentifier(c))
+		}
+		q := fmt.Sprintf("INSERT INTO main.%s (%s) SELECT ?, ?, %s FROM %s.%s", dbQuoteIdentifier(t.name), strings.Join(columns, ", "),
+			strings.Join(columns[2:], ", "), querySchemaName(0), dbQuoteIdentifier(t.name))
+		if _, err = tx.ExecContext(ctx, q, height, hash); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO main._blocks (_height, _hash) VALUES (?, ?)", height, hash); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Creates the index table for a block table, or adds the columns it doesn't have yet
+func indexEnsureTable(ctx context.Context, conn *sql.Conn, t *queryTable) error {
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", t.name)
+	if err != nil {
+		return err
+	}
+	existing := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing = append(existing, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		columns := []string{"_height INTEGER NOT NULL", "_hash VARCHAR NOT NULL"}
+		for _, c := range t.columns {
+			columns = append(columns, dbQuoteIdentifier(c))
+		}
+		name := dbQuoteIdentifier(t.name)
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", name, strings.Join(columns, ", "))); err != nil {
+			return err
+		}
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE INDEX %s ON %s(_height)", dbQuoteIdentifier(t.name+"__height"), name))
+		return err
+	}
+	for _, c := range t.columns {
+		if !inStrings(c, existing) {
+			if _, err = conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", dbQuoteIdentifier(t.name), dbQuoteIdentifier(c))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the query with the given arguments on the index database, with the tables limited to the
+// rows from the blocks in the range of heights, and calls the callback with the column names and
+// each result row. The callback can return errQueryStop to stop the query without an error.
+// Returns the number of indexed blocks in the range.
+func indexQuery(ctx context.Context, q string, args []interface{}, minHeight int, maxHeight int,
+	callback func(cols []string, row map[string]interface{}) error) (int, error) {
+	db, err := dbOpen(indexGetFilename(), true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	// Temporary views belong to a single connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name != '_meta'")
+	if err != nil {
+		return 0, err
+	}
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	// The views in the temp schema take precedence over the tables with the same names
+	for _, t := range tables {
+		name := dbQuoteIdentifier(t)
+		q := fmt.Sprintf("CREATE TEMP VIEW %s AS SELECT * FROM main.%s WHERE _height BETWEEN %d AND %d", name, name, minHeight, maxHeight)
+		if _, err = conn.ExecContext(ctx, q); err != nil {
+			return 0, err
+		}
+	}
+	var blocks int
+	if err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM _blocks").Scan(&blocks); err != nil {
+		return 0, err
+	}
+
+	rows, err = queryRestricted(ctx, conn, q, args)
+	if err != nil {
+		return blocks, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return blocks, err
+	}
+	for rows.Next() {
+		row, err := dbScanRowToMap(rows, cols)
+		if err != nil {
+			return blocks, err
+		}
+		if err = callback(cols, row); err != nil {
+			if err == errQueryStop {
+				return blocks, nil
+			}
+			return blocks, err
+		}
+	}
+	return blocks, rows.Err()
+}
@@ -23,24 +23,35 @@ var sysEventChannel = make(chan sysEventMessage, 5)
 func main() {
 	rand.Seed(p2pEphemeralID + getNowUTC()) // Initialise weak RNG with strong RNG
 	log.Println("Starting up", p2pClientVersionString, "...")
-	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
 
 	configInit()
+	httpTLSInit()
 	if processPreBlockchainActions() {
 		return
 	}
 	dbInit()
+	lightInit()
 	cryptoInit()
 	blockchainInit(true)
+	indexInit()
 	if processActions() {
 		return
 	}
+	// Commands such as call can run until interrupted, so signals are only handled from here on
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
 	log.Printf("Ephemeral ID: %x\n", p2pEphemeralID)
+	p2pTLSInit()
 	go p2pCoordinator.Run()
 	go p2pServer()
 	go p2pClient()
 	go blockWebServer()
+	if indexGetDb() != nil {
+		go indexRun()
+	}
+	if cfg.LanDiscovery {
+		go lanDiscovery()
+	}
 
 	for {
 		select {
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"testing"
+)
+
+// Creates the system databases in a temporary data directory for the duration of the test
+func testDbInit(t *testing.T) {
+	t.Helper()
+	dataDir := cfg.DataDir
+	cfg.DataDir = t.TempDir()
+	dbInit()
+	t.Cleanup(func() {
+		mainDb.Close()
+		privateDb.Close()
+		mainDb, privateDb = nil, nil
+		cfg.DataDir = dataDir
+	})
+}
+
+// Generates a key added to the blockchain at the given height, and returns it with its hash
+func testKey(t *testing.T, height int) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key := generatePrivateKey(height)
+	return key, cryptoMustGetPublicKeyHash(&key.PublicKey)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The node's metrics are exported at /metrics in the Prometheus text format. Counters and
+// histograms are updated where things happen; gauges which reflect the current state (such as
+// the chain height and the number of peers) are updated when the metrics are requested, except
+// the sync manager's, which are set by the p2p coordinator as it runs.
+
+const (
+	metricsTypeCounter = "counter"
+	metricsTypeGauge   = "gauge"
+)
+
+// A metric which can be written in the Prometheus text format
+type metricsWriter interface {
+	metricName() string
+	writeTo(w io.Writer)
+}
+
+var metricsRegistry []metricsWriter
+
+// A counter or gauge, with a value for each combination of label values
+type metricsVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	values     map[string]float64  // by label values joined with metricsLabelSeparator
+	labels     map[string][]string // the label values of each key of values
+	lock       WithMutex
+}
+
+const metricsLabelSeparator = "\xff"
+
+func newMetricsVec(metricType string, name string, help string, labelNames ...string) *metricsVec {
+	v := metricsVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+		labels:     make(map[string][]string),
+	}
+	if len(labelNames) == 0 {
+		v.values[""] = 0
+	}
+	metricsRegistry = append(metricsRegistry, &v)
+	return &v
+}
+
+// Adds delta to the value with the given label values
+func (v *metricsVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, metricsLabelSeparator)
+	v.lock.With(func() {
+		v.values[key] += delta
+		v.labels[key] = labelValues
+	})
+}
+
+// Adds 1 to the value with the given label values
+func (v *metricsVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Sets the value with the given label values
+func (v *metricsVec) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, metricsLabelSeparator)
+	v.lock.With(func() {
+		v.values[key] = value
+		v.labels[key] = labelValues
+	})
+}
+
+func (v *metricsVec) metricName() string {
+	return v.name
+}
+
+func (v *metricsVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.metricType)
+	v.lock.With(func() {
+		keys := make([]string, 0, len(v.values))
+		for key := range v.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, metricsFormatLabels(v.labelNames, v.labels[key]), metricsFormatValue(v.values[key]))
+		}
+	})
+}
+
+// A histogram of observed values, such as durations
+type metricsHistogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, in increasing order
+	counts  []uint64  // observations in each bucket (not cumulative)
+	sum     float64
+	count   uint64
+	lock    WithMutex
+}
+
+func newMetricsHistogram(name string, help string, buckets []float64) *metricsHistogram {
+	h := metricsHistogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metricsRegistry = append(metricsRegistry, &h)
+	return &h
+}
+
+// Records an observed value
+func (h *metricsHistogram) Observe(value float64) {
+	h.lock.With(func() {
+		for i, bound := range h.buckets {
+			if value <= bound {
+				h.counts[i]++
+				break
+			}
+		}
+		h.sum += value
+		h.count++
+	})
+}
+
+// Records the time since the given start time, in seconds
+func (h *metricsHistogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *metricsHistogram) metricName() string {
+	return h.name
+}
+
+func (h *metricsHistogram) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.lock.With(func() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, metricsFormatValue(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+		fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, metricsFormatValue(h.sum), h.name, h.count)
+	})
+}
+
+func metricsFormatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%s", name, strconv.Quote(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricsFormatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// The node's metrics
+var (
+	metricsChainHeight = newMetricsVec(metricsTypeGauge, "daisy_chain_height",
+		"The height of the last block in the blockchain")
+	metricsBlocksAccepted = newMetricsVec(metricsTypeCounter, "daisy_blocks_accepted_total",
+		"Blocks accepted into the blockchain")
+	metricsBlocksRejected = newMetricsVec(metricsTypeCounter, "daisy_blocks_rejected_total",
+		"Blocks rejected, by reason", "reason")
+	metricsBlockVerificationTime = newMetricsHistogram("daisy_block_verification_seconds",
+		"Time spent checking blocks before accepting them", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5})
+	metricsPeers = newMetricsVec(metricsTypeGauge, "daisy_peers",
+		"Connected p2p peers, by direction", "direction")
+	metricsBestPeerHeight = newMetricsVec(metricsTypeGauge, "daisy_peers_best_height",
+		"The highest chain height reported by a connected peer, which isn't verified")
+	metricsSyncLag = newMetricsVec(metricsTypeGauge, "daisy_sync_lag_blocks",
+		"How many blocks the chain agreed on by the sync quorum is ahead of ours")
+	metricsSyncPendingBlocks = newMetricsVec(metricsTypeGauge, "daisy_sync_pending_blocks",
+		"Blocks agreed on by the sync quorum which haven't been accepted yet")
+	metricsSyncInFlightBlocks = newMetricsVec(metricsTypeGauge, "daisy_sync_in_flight_blocks",
+		"Blocks requested from peers and not yet received")
+	metricsOrphanBlocks = newMetricsVec(metricsTypeGauge, "daisy_orphan_blocks",
+		"Blocks kept until their previous block arrives")
+	metricsP2PSentBytes = newMetricsVec(metricsTypeCounter, "daisy_p2p_sent_bytes_total",
+		"Bytes sent to p2p peers, by message type", "msg")
+	metricsP2PSentMessages = newMetricsVec(metricsTypeCounter, "daisy_p2p_sent_messages_total",
+		"Messages sent to p2p peers, by message type", "msg")
+	metricsP2PReceivedBytes = newMetricsVec(metricsTypeCounter, "daisy_p2p_received_bytes_total",
+		"Bytes received from p2p peers, by message type", "msg")
+	metricsP2PReceivedMessages = newMetricsVec(metricsTypeCounter, "daisy_p2p_received_messages_total",
+		"Messages received from p2p peers, by message type", "msg")
+)
+
+// The message types used as label values; peers could send anything else
+var metricsP2PMsgTypes = []string{
+	p2pMsgHello, p2pMsgError, p2pMsgGetBlockHashes, p2pMsgBlockHashes, p2pMsgGetHeaders, p2pMsgHeaders, p2pMsgGetBlock,
+	p2pMsgBlock, p2pMsgGetBlockChunk, p2pMsgBlockChunk, p2pMsgGetKeyOps, p2pMsgKeyOps,
+}
+
+// Counts a p2p message sent or received. The size includes the terminating newline.
+func metricsP2PMessage(sent bool, msgType string, size int) {
+	if !inStrings(msgType, metricsP2PMsgTypes) {
+		msgType = "unknown"
+	}
+	if sent {
+		metricsP2PSentBytes.Add(float64(size), msgType)
+		metricsP2PSentMessages.Inc(msgType)
+	} else {
+		metricsP2PReceivedBytes.Add(float64(size), msgType)
+		metricsP2PReceivedMessages.Inc(msgType)
+	}
+}
+
+// Updates the gauges which reflect the current state
+func metricsCollect() {
+	height := dbGetBlockchainHeight()
+	metricsChainHeight.Set(float64(height))
+	inbound, outbound := 0, 0
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc.outbound {
+				outbound++
+			} else {
+				inbound++
+			}
+		}
+	})
+	_, bestHeight := p2pPeers.SyncStatus()
+	metricsPeers.Set(float64(inbound), "inbound")
+	metricsPeers.Set(float64(outbound), "outbound")
+	metricsBestPeerHeight.Set(float64(bestHeight))
+	lag := syncGetAgreedHeight() - height
+	if lag < 0 {
+		lag = 0
+	}
+	metricsSyncLag.Set(float64(lag))
+	metricsOrphanBlocks.Set(float64(dbCountOrphans()))
+}
+
+// /metrics: the metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsCollect()
+	metrics := append([]metricsWriter{}, metricsRegistry...)
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].metricName() < metrics[j].metricName()
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
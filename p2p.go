@@ -4,24 +4,56 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const p2pClientVersionString = "godaisy/0.2"
 
+// p2pProtocolVersion is the version of the p2p protocol spoken by this node. It is incremented
+// on changes which make the protocol incompatible with older nodes; compatible additions
+// are announced as capabilities instead.
+const p2pProtocolVersion = 2
+
+// p2pMinProtocolVersion is the oldest version of the p2p protocol this node can talk to.
+// Nodes which do not send a protocol version in hello are considered to be version 1.
+const p2pMinProtocolVersion = 2
+
+// Capabilities this node announces in hello. Message types which are not a part of the base protocol
+// are only sent to peers which announce the capability they require.
+const (
+	p2pCapError   = "error"
+	p2pCapHeaders = "headers"
+	p2pCapChunks  = "chunks"
+	p2pCapKeyOps  = "keyops"
+)
+
+var p2pCapabilities = []string{p2pCapError, p2pCapHeaders, p2pCapChunks, p2pCapKeyOps}
+
+// Capabilities which a peer must announce to be able to receive the given message type
+var p2pMsgRequiredCapability = map[string]string{
+	p2pMsgError:         p2pCapError,
+	p2pMsgGetHeaders:    p2pCapHeaders,
+	p2pMsgHeaders:       p2pCapHeaders,
+	p2pMsgGetBlockChunk: p2pCapChunks,
+	p2pMsgBlockChunk:    p2pCapChunks,
+	p2pMsgGetKeyOps:     p2pCapKeyOps,
+	p2pMsgKeyOps:        p2pCapKeyOps,
+}
+
 // Header for JSON messages we're sending
 type p2pMsgHeader struct {
 	Root  string `json:"root"`
@@ -29,14 +61,32 @@ type p2pMsgHeader struct {
 	P2pID int64  `json:"p2p_id"`
 }
 
+// Returns the message type; all the message structs embed p2pMsgHeader
+func (h p2pMsgHeader) msgType() string {
+	return h.Msg
+}
+
 // The hello message
 const p2pMsgHello = "hello"
 
 type p2pMsgHelloStruct struct {
 	p2pMsgHeader
-	Version     string   `json:"version"`
-	ChainHeight int      `json:"chain_height"`
-	MyPeers     []string `json:"my_peers"`
+	Version            string   `json:"version"`
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	Capabilities       []string `json:"capabilities"`
+	ListenPort         int      `json:"listen_port"`
+	Light              bool     `json:"light,omitempty"` // the node doesn't store blocks and cannot send them
+	ChainHeight        int      `json:"chain_height"`
+	MyPeers            []string `json:"my_peers"`
+}
+
+// The message reporting an error to the peer, usually before disconnecting
+const p2pMsgError = "error"
+
+type p2pMsgErrorStruct struct {
+	p2pMsgHeader
+	Error string `json:"error"`
 }
 
 // The message asking for block hashes
@@ -56,12 +106,43 @@ type p2pMsgBlockHashesStruct struct {
 	Hashes map[int]string `json:"hashes"`
 }
 
+// The message asking for block headers
+const p2pMsgGetHeaders = "getheaders"
+
+type p2pMsgGetHeadersStruct struct {
+	p2pMsgHeader
+	MinBlockHeight int `json:"min_block_height"`
+	MaxBlockHeight int `json:"max_block_height"`
+}
+
+// The maximum number of headers sent in a single message
+const p2pMaxHeaders = 2000
+
+// The message containing block headers
+const p2pMsgHeaders = "headers"
+
+// Block metadata which can be verified without the block's data
+type p2pBlockHeader struct {
+	Height                     int    `json:"height"`
+	Hash                       string `json:"hash"`
+	PreviousBlockHash          string `json:"prev_hash"`
+	SignaturePublicKeyHash     string `json:"sigkey_hash"`
+	HashSignature              string `json:"hash_signature"`
+	PreviousBlockHashSignature string `json:"prev_hash_signature"`
+}
+
+type p2pMsgHeadersStruct struct {
+	p2pMsgHeader
+	Headers []p2pBlockHeader `json:"headers"`
+}
+
 // The message asking for block data
 const p2pMsgGetBlock = "getblock"
 
 type p2pMsgGetBlockStruct struct {
 	p2pMsgHeader
-	Hash string `json:"hash"`
+	Hash   string `json:"hash"`
+	Inline bool   `json:"inline,omitempty"` // the block URL sent by the peer couldn't be downloaded
 }
 
 // The message containing one block's data
@@ -69,11 +150,70 @@ const p2pMsgBlock = "block"
 
 type p2pMsgBlockStruct struct {
 	p2pMsgHeader
-	Hash          string `json:"hash"`
-	HashSignature string `json:"hash_signature"`
-	Size          int64  `json:"size"`
-	Encoding      string `json:"encoding"`
-	Data          string `json:"data"`
+	Hash          string   `json:"hash"`
+	HashSignature string   `json:"hash_signature"`
+	Size          int64    `json:"size"`
+	Encoding      string   `json:"encoding"`
+	Data          string   `json:"data"`
+	ChunkSize     int64    `json:"chunk_size,omitempty"`
+	ChunkHashes   []string `json:"chunk_hashes,omitempty"`
+}
+
+// The message asking for a part of a block's data
+const p2pMsgGetBlockChunk = "getblockchunk"
+
+type p2pMsgGetBlockChunkStruct struct {
+	p2pMsgHeader
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// The message containing a part of a block's data
+const p2pMsgBlockChunk = "blockchunk"
+
+type p2pMsgBlockChunkStruct struct {
+	p2pMsgHeader
+	Hash      string `json:"hash"`
+	Offset    int64  `json:"offset"`
+	ChunkHash string `json:"chunk_hash"`
+	Data      string `json:"data"`
+}
+
+// The message asking for the key ops of blocks, used by light nodes which don't download the blocks
+const p2pMsgGetKeyOps = "getkeyops"
+
+type p2pMsgGetKeyOpsStruct struct {
+	p2pMsgHeader
+	MinBlockHeight int `json:"min_block_height"`
+	MaxBlockHeight int `json:"max_block_height"`
+}
+
+// The maximum number of blocks whose key ops are sent in a single message
+const p2pMaxKeyOpsBlocks = 100
+
+// The message containing the key ops of blocks
+const p2pMsgKeyOps = "keyops"
+
+// A key op from a block's _keys table
+type p2pKeyOp struct {
+	Op               string `json:"op"`
+	PublicKeyHash    string `json:"pubkey_hash"`
+	PublicKey        string `json:"pubkey"`
+	SignatureKeyHash string `json:"sigkey_hash"`
+	Signature        string `json:"signature"`
+}
+
+// All the key ops of a block
+type p2pBlockKeyOps struct {
+	Height int        `json:"height"`
+	Hash   string     `json:"hash"`
+	KeyOps []p2pKeyOp `json:"key_ops"`
+}
+
+type p2pMsgKeyOpsStruct struct {
+	p2pMsgHeader
+	Blocks []p2pBlockKeyOps `json:"blocks"`
 }
 
 // Map of peer addresses, for easy set-like behaviour
@@ -93,9 +233,19 @@ type p2pConnection struct {
 	address           string // host:port
 	peer              *bufio.ReadWriter
 	peerID            int64
-	isConnectable     bool // using the default port
-	testedConnectable bool // using the default port
-	chainHeight       int
+	peerKeyHash       string // hash of the public key the peer has authenticated with
+	outbound          bool   // we have connected to the peer
+	listenPort        int    // the port the peer accepts connections on, as advertised in hello
+	light             bool   // the peer is a light node, which doesn't have the blocks
+	isConnectable     bool   // accepts connections on its listening port
+	testedConnectable bool   // the listening port has been checked
+	chainHeight       int    // the highest block the peer has reported, written under p2pPeers.lock
+	protocolVersion   int
+	capabilities      map[string]bool // capabilities announced by the peer which this node also has
+	helloReceived     bool
+	blockInline       bool            // the peer has reported it cannot download blocks from our URLs
+	inlineRequested   map[string]bool // blocks asked to be sent inline after their URL failed
+	requestedBlocks   map[string]bool // blocks the sync manager has requested from the peer, written under p2pPeers.lock
 	refreshTime       time.Time
 	chanToPeer        chan interface{} // structs go out
 	chanFromPeer      chan StrIfMap    // StrIfMaps go in
@@ -110,25 +260,29 @@ type p2pPeersSet struct {
 // The global set of p2p connections. XXX: Singletons in Go?
 var p2pPeers = p2pPeersSet{peers: make(map[*p2pConnection]time.Time)}
 
-// Adds a p2p connections to the set of p2p connections
+// Adds a p2p connections to the set of p2p connections, and publishes the peer-connected event
 func (p *p2pPeersSet) Add(c *p2pConnection) {
 	p.lock.With(func() {
 		p.peers[c] = time.Now()
 	})
+	eventBus.Publish(busEventPeerConnected, busPeerEvent{address: c.address, outbound: c.outbound})
 }
 
-// Removes a p2p connection from the set of p2p connections
+// Removes a p2p connection from the set of p2p connections, and publishes the peer-disconnected event
 func (p *p2pPeersSet) Remove(c *p2pConnection) {
 	p.lock.With(func() {
 		delete(p.peers, c)
 	})
+	eventBus.Publish(busEventPeerDisconnected, busPeerEvent{address: c.address, outbound: c.outbound})
 }
 
+// Returns true if there is a connection to the peer with the given address, or to a peer
+// which has advertised it accepts connections on the given address.
 func (p *p2pPeersSet) HasAddress(address string) bool {
 	found := false
 	p.lock.With(func() {
 		for peer := range p.peers {
-			if peer.address == address {
+			if peer.address == address || (peer.helloReceived && peer.canonicalAddress() == address) {
 				found = true
 				break
 			}
@@ -137,11 +291,48 @@ func (p *p2pPeersSet) HasAddress(address string) bool {
 	return found
 }
 
+// Returns the number of peers which have completed the handshake, and the highest chain height
+// they have reported
+func (p *p2pPeersSet) SyncStatus() (int, int) {
+	n, bestHeight := 0, 0
+	p.lock.With(func() {
+		for peer := range p.peers {
+			if !peer.helloReceived {
+				continue
+			}
+			n++
+			if peer.chainHeight > bestHeight {
+				bestHeight = peer.chainHeight
+			}
+		}
+	})
+	return n, bestHeight
+}
+
+// Returns the number of connections which peers have made to us
+func (p *p2pPeersSet) CountInbound() int {
+	n := 0
+	p.lock.With(func() {
+		for peer := range p.peers {
+			if !peer.outbound {
+				n++
+			}
+		}
+	})
+	return n
+}
+
+// Returns the addresses of the peers. The addresses of connectable peers are returned
+// with their listening port, so other nodes can connect to them.
 func (p *p2pPeersSet) GetAddresses(onlyConnectable bool) []string {
 	var addresses []string
 	p.lock.With(func() {
 		for peer := range p.peers {
-			if onlyConnectable && !peer.isConnectable {
+			if onlyConnectable {
+				if !peer.isConnectable {
+					continue
+				}
+				addresses = append(addresses, peer.canonicalAddress())
 				continue
 			}
 			addresses = append(addresses, peer.address)
@@ -150,41 +341,37 @@ func (p *p2pPeersSet) GetAddresses(onlyConnectable bool) []string {
 	return addresses
 }
 
+// Checks whether the peers which have connected to us accept connections on the port
+// they have advertised in hello.
 func (p *p2pPeersSet) tryPeersConnectable() {
-	addressesToTry := map[string]string{}
+	addressesToTry := map[*p2pConnection]string{}
 
 	p.lock.With(func() {
 		for peer := range p.peers {
-			if peer.testedConnectable || peer.isConnectable {
+			if peer.testedConnectable || peer.isConnectable || !peer.helloReceived {
 				continue
 			}
-			host, port, err := splitAddress(peer.address)
+			_, port, err := splitAddress(peer.address)
 			if err != nil {
 				continue
 			}
-			if port == DefaultP2PPort {
+			peer.testedConnectable = true
+			if port == peer.listenPort {
 				// we're already connected to it
+				peer.isConnectable = true
 				continue
 			}
-
-			address := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
-			peer.testedConnectable = true
-
-			addressesToTry[peer.address] = address
+			addressesToTry[peer] = peer.canonicalAddress()
 		}
 	})
 
-	for paddress, address := range addressesToTry {
-		conn, err := net.Dial("tcp", address)
+	for peer, address := range addressesToTry {
+		conn, err := net.DialTimeout("tcp", address, p2pHandshakeTimeout)
 		if err != nil {
 			continue
 		}
 		p.lock.With(func() {
-			for peer := range p.peers {
-				if peer.address == paddress {
-					peer.isConnectable = true
-				}
-			}
+			peer.isConnectable = true
 		})
 
 		err = conn.Close()
@@ -196,40 +383,64 @@ func (p *p2pPeersSet) tryPeersConnectable() {
 
 func (p *p2pPeersSet) saveConnectablePeers() {
 	dbPeers := dbGetSavedPeers()
-	localAddresses := getLocalAddresses()
+	var canonicalAddresses []string
 
 	p.lock.With(func() {
 		for peer := range p.peers {
-			if !peer.isConnectable {
-				continue
+			if peer.isConnectable {
+				canonicalAddresses = append(canonicalAddresses, peer.canonicalAddress())
 			}
-			host, _, err := splitAddress(peer.address)
-			if err != nil {
-				continue
-			}
-			canonicalAddress := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
-			addr, err := net.ResolveTCPAddr("tcp", canonicalAddress)
-			if err != nil {
-				continue
-			}
-			if _, ok := dbPeers[addr.IP.String()]; ok {
-				// Already in db
-				continue
-			}
-			if inStrings(addr.String(), localAddresses) {
-				// Local interface
-				continue
-			}
-			log.Println("Detected canonical peer at", canonicalAddress)
-			dbSavePeer(canonicalAddress)
 		}
 	})
 
+	for _, canonicalAddress := range canonicalAddresses {
+		if _, ok := dbPeers[canonicalAddress]; ok {
+			// Already in db
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", canonicalAddress)
+		if err != nil || p2pIsMyAddress(addr) {
+			continue
+		}
+		log.Println("Detected canonical peer at", canonicalAddress)
+		dbSavePeer(canonicalAddress, p2pPeerSourceInbound)
+	}
+}
+
+// Returns the address ("host:port") the peer accepts connections on, made from the host it
+// has connected from and the port it has advertised in hello.
+func (p2pc *p2pConnection) canonicalAddress() string {
+	host, _, err := net.SplitHostPort(p2pc.address)
+	if err != nil {
+		host = p2pc.address
+	}
+	port := p2pc.listenPort
+	if port == 0 {
+		port = DefaultP2PPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Returns the address with the default p2p port added if it doesn't have a port
+func p2pAddressWithPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(DefaultP2PPort))
+}
+
+// Returns true if the address is this node's p2p listening address. Other nodes on the same host
+// have different ports.
+func p2pIsMyAddress(addr *net.TCPAddr) bool {
+	if addr.Port != cfg.P2pPort {
+		return false
+	}
+	return addr.IP.IsLoopback() || addr.IP.IsUnspecified() || inStrings(addr.IP.String(), getLocalAddresses())
 }
 
 func p2pServer() {
 	serverAddress := ":" + strconv.Itoa(cfg.P2pPort)
-	l, err := net.Listen("tcp", serverAddress)
+	l, err := tls.Listen("tcp", serverAddress, p2pTLSConfig)
 	if err != nil {
 		log.Println("Cannot listen on", serverAddress)
 		log.Fatal(err)
@@ -252,7 +463,14 @@ func p2pServer() {
 			log.Println("Ignoring bad peer", conn.RemoteAddr().String())
 			continue
 		}
-		p2pc, err := p2pSetupPeer(conn.RemoteAddr().String(), conn)
+		if p2pPeers.CountInbound() >= cfg.P2pMaxInbound {
+			log.Println("Too many incoming connections, refusing", conn.RemoteAddr().String())
+			if err = conn.Close(); err != nil {
+				log.Printf("conn.Close: %v", err)
+			}
+			continue
+		}
+		p2pc, err := p2pSetupPeer(conn.RemoteAddr().String(), conn, false)
 		if err != nil {
 			log.Println("Error setting up peer", conn.RemoteAddr().String(), err)
 			continue
@@ -262,7 +480,7 @@ func p2pServer() {
 }
 
 func p2pClient() {
-	p2pCoordinator.connectDbPeers()
+	p2pConnMgr.Maintain()
 }
 
 func (p2pc *p2pConnection) sendMsg(msg interface{}) error {
@@ -285,13 +503,22 @@ func (p2pc *p2pConnection) sendMsg(msg interface{}) error {
 		return errors.New("didn't write newline")
 	}
 	//log.Println("... successfully wrote", string(bmsg))
-	return p2pc.peer.Flush()
+	if err = p2pc.peer.Flush(); err != nil {
+		return err
+	}
+	msgType := ""
+	if m, ok := msg.(interface{ msgType() string }); ok {
+		msgType = m.msgType()
+	}
+	metricsP2PMessage(true, msgType, len(bmsg)+1)
+	return nil
 }
 
 func (p2pc *p2pConnection) handleConnection() {
 	defer func() {
 		log.Println("Cleaning up connection", p2pc.address)
 		p2pPeers.Remove(p2pc)
+		p2pc.releaseBlockDownloads()
 		err := p2pc.conn.Close()
 		if err != nil {
 			log.Printf("p2pc.conn.Close: %v", err)
@@ -299,6 +526,26 @@ func (p2pc *p2pConnection) handleConnection() {
 		log.Println("Finished cleaning up connection", p2pc.address)
 	}()
 
+	// Outgoing connections to saved peers are pinned to the key the peer first authenticated with.
+	// The outcome of outgoing connections is recorded in the address book.
+	dialAddress := p2pc.address
+	timeStarted := time.Now()
+	err := p2pc.authenticate(dbGetPeerKeyHash(dialAddress))
+	if err != nil {
+		log.Println("Cannot authenticate peer", p2pc.address, err)
+		p2pCoordinator.badPeers.Add(p2pc.address)
+		if p2pc.outbound {
+			dbRecordPeerFailure(dialAddress)
+			p2pConnMgr.Failed(dialAddress)
+		}
+		return
+	}
+	if p2pc.outbound {
+		dbRecordPeerSuccess(dialAddress, time.Since(timeStarted))
+		p2pConnMgr.Succeeded(dialAddress)
+	}
+	dbPinPeerKeyHash(dialAddress, p2pc.peerKeyHash)
+
 	// Only store the IP address as the address.
 	// This must be done in the goroutine because resolving can block for a long time.
 	addr, err := net.ResolveTCPAddr("tcp", p2pc.address)
@@ -316,46 +563,76 @@ func (p2pc *p2pConnection) handleConnection() {
 			Root:  chainParams.GenesisBlockHash,
 			Msg:   p2pMsgHello,
 		},
-		Version:     p2pClientVersionString,
-		ChainHeight: dbGetBlockchainHeight(),
-		MyPeers:     p2pPeers.GetAddresses(true),
+		Version:            p2pClientVersionString,
+		ProtocolVersion:    p2pProtocolVersion,
+		MinProtocolVersion: p2pMinProtocolVersion,
+		Capabilities:       p2pCapabilities,
+		ListenPort:         cfg.P2pPort,
+		Light:              cfg.Light,
+		ChainHeight:        dbGetBlockchainHeight(),
+		MyPeers:            p2pPeers.GetAddresses(true),
 	}
 	err = p2pc.sendMsg(helloMsg)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	log.Println("Handling connection", p2pc.address)
+	log.Println("Handling connection", p2pc.address, "with key", p2pc.peerKeyHash)
 	exit := false
 
+	// The receiver goroutine reads at most one line of limited size at a time, at a limited rate, and
+	// blocks while the queue to the handler is full, so a peer cannot make us buffer unbounded data.
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		var line []byte
+		deliver := func(msg StrIfMap) bool {
+			select {
+			case p2pc.chanFromPeer <- msg:
+				return true
+			case <-done:
+				return false
+			}
+		}
+		limiter := NewRateLimiter(cfg.P2pMsgRate, cfg.P2pMsgBurst)
 		for {
-			line, err = p2pc.peer.ReadBytes('\n')
+			line, err := readLineLimited(p2pc.peer.Reader, cfg.P2pMaxLineSize)
+			if err == errLineTooLong {
+				log.Println("Message from", p2pc.address, "is longer than", cfg.P2pMaxLineSize, "bytes")
+				p2pPeerScores.Penalize(p2pc, p2pPenaltyOversized, "message too long")
+				deliver(StrIfMap{"_error": "Message too long"})
+				break
+			}
 			if err != nil {
 				log.Println("Error reading data from", p2pc.address, err)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Error reading data"}
+				deliver(StrIfMap{"_error": "Error reading data"})
 				break
 			}
 			var msg StrIfMap
 			err = json.Unmarshal(line, &msg)
+			msgType, _ := msg.GetString("msg")
+			metricsP2PMessage(false, msgType, len(line))
 			if err != nil {
 				log.Println("Cannot parse JSON", strconv.QuoteToASCII(string(line)), "from", p2pc.address)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Cannot parse JSON"}
+				p2pPeerScores.Penalize(p2pc, p2pPenaltyBadJSON, "unparsable JSON")
+				deliver(StrIfMap{"_error": "Cannot parse JSON"})
 				break
 			}
 
 			var root string
 			if root, err = msg.GetString("root"); err != nil {
 				log.Printf("Problem with chain root from  %v: %v", p2pc.address, err)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Problem with chain root"}
+				deliver(StrIfMap{"_error": "Problem with chain root"})
 				break
 			}
 			if root != chainParams.GenesisBlockHash {
 				log.Printf("Received message from %v for a different chain than mine (%s vs %s). Ignoring.", p2pc.conn, root, chainParams.GenesisBlockHash)
+				p2pPeerScores.Penalize(p2pc, p2pPenaltyWrongRoot, "wrong chain root")
 				continue
 			}
-			p2pc.chanFromPeer <- msg
+			limiter.Wait()
+			if !deliver(msg) {
+				break
+			}
 		}
 		log.Println("Shutting down receiver for", p2pc.address)
 		exit = true // In any case, if this goroutine exits, we want to shut down everything
@@ -380,17 +657,41 @@ func (p2pc *p2pConnection) handleConnection() {
 				exit = true
 				break
 			}
+			if cmd != p2pMsgHello && !p2pc.helloReceived {
+				log.Printf("Message %s from %v before hello, ignoring", cmd, p2pc.address)
+				break
+			}
+			if capability, ok := p2pMsgRequiredCapability[cmd]; ok && !p2pc.hasCapability(capability) {
+				log.Printf("Message %s from %v which didn't negotiate %s, ignoring", cmd, p2pc.address, capability)
+				break
+			}
 			switch cmd {
 			case p2pMsgHello:
 				p2pc.handleMsgHello(msg)
+			case p2pMsgError:
+				p2pc.handleError(msg)
 			case p2pMsgGetBlockHashes:
 				p2pc.handleGetBlockHashes(msg)
 			case p2pMsgBlockHashes:
 				p2pc.handleBlockHashes(msg)
+			case p2pMsgGetHeaders:
+				p2pc.handleGetHeaders(msg)
+			case p2pMsgHeaders:
+				p2pc.handleHeaders(msg)
 			case p2pMsgGetBlock:
 				p2pc.handleGetBlock(msg)
 			case p2pMsgBlock:
 				p2pc.handleBlock(msg)
+			case p2pMsgGetBlockChunk:
+				p2pc.handleGetBlockChunk(msg)
+			case p2pMsgBlockChunk:
+				p2pc.handleBlockChunk(msg)
+			case p2pMsgGetKeyOps:
+				p2pc.handleGetKeyOps(msg)
+			case p2pMsgKeyOps:
+				p2pc.handleKeyOps(msg)
+			default:
+				log.Printf("Unknown message %s from %v, ignoring", cmd, p2pc.address)
 			}
 		case msg := <-p2pc.chanToPeer:
 			err := p2pc.sendMsg(msg)
@@ -413,7 +714,8 @@ func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 		log.Println(p2pc.conn, err)
 		return
 	}
-	if p2pc.chainHeight, err = msg.GetInt("chain_height"); err != nil {
+	var chainHeight int
+	if chainHeight, err = msg.GetInt("chain_height"); err != nil {
 		log.Println(p2pc.conn, err)
 		return
 	}
@@ -423,11 +725,46 @@ func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 			return
 		}
 	}
+	if p2pc.protocolVersion, err = msg.GetInt("protocol_version"); err != nil {
+		p2pc.protocolVersion = 1
+	}
+	peerMinProtocolVersion, err := msg.GetInt("min_protocol_version")
+	if err != nil {
+		peerMinProtocolVersion = p2pc.protocolVersion
+	}
+	if p2pc.protocolVersion < p2pMinProtocolVersion || peerMinProtocolVersion > p2pProtocolVersion {
+		p2pc.refuse(fmt.Sprintf("Incompatible protocol version: peer speaks %d (min %d), I speak %d (min %d)",
+			p2pc.protocolVersion, peerMinProtocolVersion, p2pProtocolVersion, p2pMinProtocolVersion))
+		return
+	}
+	p2pc.capabilities = make(map[string]bool)
+	if peerCapabilities, err := msg.GetStringList("capabilities"); err == nil {
+		for _, capability := range peerCapabilities {
+			if inStrings(capability, p2pCapabilities) {
+				p2pc.capabilities[capability] = true
+			}
+		}
+	}
+	listenPort, err := msg.GetInt("listen_port")
+	if err != nil || listenPort < 1 || listenPort > 65535 {
+		// Older nodes only listen on the default port
+		listenPort = DefaultP2PPort
+	}
+	light, err := msg.GetBool("light")
+	if err != nil {
+		light = false
+	}
+	p2pPeers.lock.With(func() {
+		p2pc.listenPort = listenPort
+		p2pc.light = light
+		p2pc.chainHeight = chainHeight
+		p2pc.helloReceived = true
+	})
 	var remotePeers []string
 	if remotePeers, err = msg.GetStringList("my_peers"); err == nil {
 		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlConnectPeers, payload: remotePeers}
 	}
-	log.Printf("Hello from %v %s (%x) %d blocks", p2pc.address, ver, p2pc.peerID, p2pc.chainHeight)
+	log.Printf("Hello from %v %s (%x) protocol %d %d blocks", p2pc.address, ver, p2pc.peerID, p2pc.protocolVersion, chainHeight)
 	// Check for duplicates
 	dup := false
 	p2pPeers.lock.With(func() {
@@ -452,11 +789,90 @@ func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 		return
 	}
 	p2pc.refreshTime = time.Now()
-	if p2pc.chainHeight > dbGetBlockchainHeight() {
+	if chainHeight > dbGetBlockchainHeight() {
 		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: p2pc}
 	}
 }
 
+// Returns true if the capability has been negotiated with the peer
+func (p2pc *p2pConnection) hasCapability(capability string) bool {
+	return p2pc.capabilities[capability]
+}
+
+// Returns the highest block height the peer has reported
+func (p2pc *p2pConnection) getChainHeight() int {
+	var height int
+	p2pPeers.lock.With(func() {
+		height = p2pc.chainHeight
+	})
+	return height
+}
+
+// Records a block height the peer has reported, if it's higher than the known one
+func (p2pc *p2pConnection) raiseChainHeight(height int) {
+	p2pPeers.lock.With(func() {
+		if height > p2pc.chainHeight {
+			p2pc.chainHeight = height
+		}
+	})
+}
+
+// Records whether the sync manager is waiting for the block with the given hash from the peer
+func (p2pc *p2pConnection) setBlockRequested(hash string, requested bool) {
+	p2pPeers.lock.With(func() {
+		if !requested {
+			delete(p2pc.requestedBlocks, hash)
+			return
+		}
+		if p2pc.requestedBlocks == nil {
+			p2pc.requestedBlocks = make(map[string]bool)
+		}
+		p2pc.requestedBlocks[hash] = true
+	})
+}
+
+// Returns true if the sync manager is waiting for the block with the given hash from the peer
+func (p2pc *p2pConnection) isBlockRequested(hash string) bool {
+	var requested bool
+	p2pPeers.lock.With(func() {
+		requested = p2pc.requestedBlocks[hash]
+	})
+	return requested
+}
+
+// Sends an error message to the peer (if it understands it) and closes the connection.
+// Must be called from the connection's handler goroutine.
+func (p2pc *p2pConnection) refuse(reason string) {
+	log.Printf("Refusing peer %v: %s", p2pc.address, reason)
+	if p2pc.hasCapability(p2pCapError) || !p2pc.helloReceived {
+		// The peer's capabilities might not be known yet; older peers ignore unknown messages.
+		msg := p2pMsgErrorStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pEphemeralID,
+				Root:  chainParams.GenesisBlockHash,
+				Msg:   p2pMsgError,
+			},
+			Error: reason,
+		}
+		if err := p2pc.sendMsg(msg); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := p2pc.conn.Close(); err != nil {
+		log.Printf("p2pc.conn.Close: %v", err)
+	}
+}
+
+// error: the peer reports an error
+func (p2pc *p2pConnection) handleError(msg StrIfMap) {
+	reason, err := msg.GetString("error")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	log.Printf("Error reported by %v: %s", p2pc.address, reason)
+}
+
 // Handle getblockhashes
 func (p2pc *p2pConnection) handleGetBlockHashes(msg StrIfMap) {
 	var minBlockHeight int
@@ -479,7 +895,10 @@ func (p2pc *p2pConnection) handleGetBlockHashes(msg StrIfMap) {
 		},
 		Hashes: dbGetHeightHashes(minBlockHeight, maxBlockHeight),
 	}
-	p2pc.chanToPeer <- respMsg
+	// Called from the connection's goroutine, which also drains chanToPeer, so write directly
+	if err = p2pc.sendMsg(respMsg); err != nil {
+		log.Println("Error sending block hashes to", p2pc.address, err)
+	}
 }
 
 // Handle receiving blockhashes
@@ -500,27 +919,88 @@ func (p2pc *p2pConnection) handleBlockHashes(msg StrIfMap) {
 	log.Println("handleBlockHashes: got", jsonifyWhatever(heights))
 	for _, h := range heights {
 		if dbBlockHeightExists(h) {
-			log.Println("handleBlockHashes: already have block:", h)
 			if dbGetBlockHashByHeight(h) != hashes[h] {
 				log.Println("ERROR: Blockchain desynced: received block hash at height", h, "to be", hashes[h], "instead of", dbGetBlockHashByHeight(h))
+				p2pPeerScores.Penalize(p2pc, p2pPenaltyDesync, "block hash desync")
 				return
 			}
-			continue
 		}
-		if p2pCoordinator.recentlyRequestedBlocks.TestAndSet(hashes[h]) {
-			continue
+	}
+	if len(heights) > 0 {
+		p2pc.raiseChainHeight(heights[len(heights)-1])
+	}
+	p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlBlockHashes, payload: &syncBlockHashes{peer: p2pc, hashes: hashes}}
+}
+
+// getheaders: a request for block headers
+func (p2pc *p2pConnection) handleGetHeaders(msg StrIfMap) {
+	var minBlockHeight int
+	var maxBlockHeight int
+	var err error
+	if minBlockHeight, err = msg.GetInt("min_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if maxBlockHeight, err = msg.GetInt("max_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if maxBlockHeight-minBlockHeight >= p2pMaxHeaders {
+		maxBlockHeight = minBlockHeight + p2pMaxHeaders - 1
+	}
+	if myHeight := dbGetBlockchainHeight(); maxBlockHeight > myHeight {
+		maxBlockHeight = myHeight
+	}
+	headers := []p2pBlockHeader{}
+	for h := minBlockHeight; h <= maxBlockHeight; h++ {
+		dbb, err := dbGetBlockByHeight(h)
+		if err != nil {
+			break
 		}
-		log.Println("Requesting block", hashes[h])
-		msg := p2pMsgGetBlockStruct{
-			p2pMsgHeader: p2pMsgHeader{
-				P2pID: p2pEphemeralID,
-				Root:  chainParams.GenesisBlockHash,
-				Msg:   p2pMsgGetBlock,
-			},
-			Hash: hashes[h],
+		headers = append(headers, p2pBlockHeader{
+			Height:                     dbb.Height,
+			Hash:                       dbb.Hash,
+			PreviousBlockHash:          dbb.PreviousBlockHash,
+			SignaturePublicKeyHash:     dbb.SignaturePublicKeyHash,
+			HashSignature:              hex.EncodeToString(dbb.HashSignature),
+			PreviousBlockHashSignature: hex.EncodeToString(dbb.PreviousBlockHashSignature),
+		})
+	}
+	log.Printf("*** Sending %d block headers from %d to %s", len(headers), minBlockHeight, p2pc.address)
+	respMsg := p2pMsgHeadersStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgHeaders,
+		},
+		Headers: headers,
+	}
+	// Called from the connection's goroutine, which also drains chanToPeer, so write directly
+	if err = p2pc.sendMsg(respMsg); err != nil {
+		log.Println("Error sending block headers to", p2pc.address, err)
+	}
+}
+
+// headers: block headers are received
+func (p2pc *p2pConnection) handleHeaders(msg StrIfMap) {
+	var headers []p2pBlockHeader
+	if err := msg.Decode("headers", &headers); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if len(headers) > p2pMaxHeaders {
+		log.Println("Too many headers from", p2pc.address)
+		return
+	}
+	for _, hdr := range headers {
+		if dbBlockHeightExists(hdr.Height) && dbGetBlockHashByHeight(hdr.Height) != hdr.Hash {
+			log.Println("ERROR: Blockchain desynced: received block header at height", hdr.Height, "to be", hdr.Hash, "instead of", dbGetBlockHashByHeight(hdr.Height))
+			p2pPeerScores.Penalize(p2pc, p2pPenaltyDesync, "block header desync")
+			return
 		}
-		p2pc.chanToPeer <- msg
+		p2pc.raiseChainHeight(hdr.Height)
 	}
+	p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlHeaders, payload: &syncHeaders{peer: p2pc, headers: headers}}
 }
 
 // getblock: a request to transfer a block
@@ -530,6 +1010,10 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 		log.Println(p2pc.conn, err)
 		return
 	}
+	if cfg.Light {
+		log.Println("Light node, cannot send block", hash, "to", p2pc.address)
+		return
+	}
 	dbb, err := dbGetBlock(hash)
 	if err != nil {
 		log.Println(p2pc.conn, err)
@@ -543,9 +1027,32 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 	}
 	fileSize := st.Size()
 
+	if inline, err := msg.GetBool("inline"); err == nil && inline && !p2pc.blockInline {
+		log.Println("Peer", p2pc.address, "cannot download blocks over HTTP, sending them inline")
+		p2pc.blockInline = true
+	}
+	sendInline := cfg.p2pBlockInline || p2pc.blockInline
+	var blockURL string
+	if !sendInline {
+		if blockURL, err = blockWebGetBlockURL(p2pc.conn.LocalAddr(), dbb.Height); err != nil {
+			log.Println("Cannot make a block URL, sending the block inline:", err)
+			sendInline = true
+		}
+	}
+
 	var msgBlockEncoding, msgBlockData string
+	var chunkSize int64
+	var chunkHashes []string
 
-	if cfg.p2pBlockInline {
+	if p2pc.hasCapability(p2pCapChunks) && fileSize > cfg.P2pChunkSize {
+		chunkHashes, err = blockFileChunkHashes(fileName, cfg.P2pChunkSize)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		msgBlockEncoding = "chunked"
+		chunkSize = cfg.P2pChunkSize
+	} else if sendInline {
 		f, err := os.Open(fileName)
 		if err != nil {
 			log.Println(err)
@@ -576,7 +1083,7 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 		msgBlockData = base64.StdEncoding.EncodeToString(zbuf.Bytes())
 	} else {
 		msgBlockEncoding = "http"
-		msgBlockData = fmt.Sprintf("http://%s:%d/block/%d", getLocalAddresses()[0], cfg.httpPort, dbb.Height)
+		msgBlockData = blockURL
 		log.Println("*** Instructing the peer to get a block from", msgBlockData)
 	}
 
@@ -591,12 +1098,20 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 		Encoding:      msgBlockEncoding,
 		Data:          msgBlockData,
 		Size:          fileSize,
+		ChunkSize:     chunkSize,
+		ChunkHashes:   chunkHashes,
+	}
+	// Called from the connection's goroutine, which also drains chanToPeer, so write directly
+	if err = p2pc.sendMsg(respMsg); err != nil {
+		log.Println("Error sending block", hash, "to", p2pc.address, err)
+		return
 	}
-	p2pc.chanToPeer <- respMsg
 	log.Println("*** Sent block", hash, "to", p2pc.address)
 }
 
-// block: A block is received
+// block: A block is received. It is saved to a temporary file in the data directory and handed
+// over to the sync manager, which imports blocks in height order. Chunked blocks only announce
+// their chunks here, the data arrives in blockchunk messages.
 func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
 	hash, err := msg.GetString("hash")
 	if err != nil {
@@ -613,7 +1128,18 @@ func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
 		log.Println(err)
 		return
 	}
-	if dbBlockHashExists(hash) {
+	if !blockHashRegexp.MatchString(hash) {
+		log.Println("Invalid block hash from", p2pc.address)
+		p2pPeerScores.Penalize(p2pc, p2pPenaltyInvalidBlock, "invalid block hash")
+		return
+	}
+	if !p2pc.isBlockRequested(hash) {
+		// Nothing is downloaded or saved for blocks the sync manager isn't waiting for
+		log.Println("Ignoring block", hash, "from", p2pc.address, "which wasn't requested from it")
+		return
+	}
+	if dbBlockHashExists(hash) && !cfg.Light {
+		// Light nodes have the headers of the blocks they fetch
 		log.Println("Replacing blocks not yet implemented")
 		return
 	}
@@ -621,33 +1147,48 @@ func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
 	if err != nil {
 		log.Println(err)
 	}
-	var blockFile *os.File
 	encoding, err := msg.GetString("encoding")
 	if err != nil {
 		log.Printf("encoding: %v", err)
 		return
 	}
-	if encoding == "zlib-base64" {
-		zlibData, err := base64.StdEncoding.DecodeString(dataString)
+	if fileSize < 0 || fileSize > cfg.P2pMaxBlockSize {
+		log.Println("Block", hash, "from", p2pc.address, "is too large:", fileSize, "bytes")
+		p2pPeerScores.Penalize(p2pc, p2pPenaltyOversized, "block too large")
+		metricsBlocksRejected.Inc("too_large")
+		return
+	}
+	var blockReader io.Reader
+	if encoding == "chunked" {
+		chunkSize, err := msg.GetInt64("chunk_size")
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		blockFile, err = ioutil.TempFile("", "daisy")
+		var chunkHashes []string
+		if err = msg.Decode("chunk_hashes", &chunkHashes); err != nil {
+			log.Println(err)
+			return
+		}
+		if chunkSize < 1 || len(chunkHashes) != blockChunkCount(fileSize, chunkSize) {
+			log.Println("Invalid chunks of block", hash, "from", p2pc.address)
+			p2pPeerScores.Penalize(p2pc, p2pPenaltySizeMismatch, "invalid chunks")
+			return
+		}
+		if chunkSize*4/3+1024 > int64(cfg.P2pMaxLineSize) {
+			log.Println("Chunks of block", hash, "from", p2pc.address, "are too large:", chunkSize, "bytes")
+			return
+		}
+		if err = p2pc.startBlockDownload(hash, hashSignature, fileSize, chunkSize, chunkHashes); err != nil {
+			log.Println("Error downloading block", hash, err)
+		}
+		return
+	} else if encoding == "zlib-base64" {
+		zlibData, err := base64.StdEncoding.DecodeString(dataString)
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		defer func() {
-			err = blockFile.Close()
-			if err != nil {
-				log.Printf("handleBlock blockFile.Close: %v", err)
-			}
-			err = os.Remove(blockFile.Name())
-			if err != nil {
-				log.Printf("remove: %v", err)
-			}
-		}()
 		r, err := zlib.NewReader(bytes.NewReader(zlibData))
 		if err != nil {
 			log.Println(err)
@@ -659,85 +1200,173 @@ func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
 				log.Printf("handleBlock r.Close: %v", err)
 			}
 		}()
-		written, err := io.Copy(blockFile, r)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		if written != fileSize {
-			log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
-			return
-		}
+		blockReader = r
 	} else if encoding == "http" {
 		log.Println("Getting block", hash, "from", dataString)
-		resp, err := http.Get(dataString)
+		resp, err := blockWebDownloadClient.Get(dataString)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP status %s", resp.Status)
+		}
 		if err != nil {
 			log.Println("Error receiving block at", dataString, err)
+			p2pc.blockURLFailedFallback(hash)
 			return
 		}
 		defer resp.Body.Close()
-		blockFile, err = ioutil.TempFile("", "daisy")
-		if err != nil {
-			log.Println("Error creating temp file", err)
-			return
-		}
-		written, err := io.Copy(blockFile, resp.Body)
-		if err != nil {
-			log.Println("Error saving block:", err)
-			blockFile.Close()
-			os.Remove(blockFile.Name())
-			return
-		}
-		if written != fileSize {
-			log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
-			blockFile.Close()
-			os.Remove(blockFile.Name())
-			return
-		}
-		err = blockFile.Close()
-		if err != nil {
-			log.Printf("handleBlock blockFile.Close: %v", err)
-		}
-		defer func() {
-			err = os.Remove(blockFile.Name())
-			if err != nil {
-				log.Printf("remove: %v", err)
-			}
-		}()
+		blockReader = resp.Body
 	} else {
 		log.Println("Unknown block encoding:", encoding)
 		return
 	}
 
-	blk, err := OpenBlockFile(blockFile.Name())
+	blockFile, err := blockDownloadTempFile()
 	if err != nil {
-		log.Println("Error opening block file", p2pc.conn, err)
+		log.Println("Error creating temp file", err)
 		return
 	}
-	blk.HashSignature, err = hex.DecodeString(hashSignature)
+	written, err := io.Copy(blockFile, io.LimitReader(blockReader, fileSize+1))
+	if err != nil {
+		log.Println("Error saving block:", err)
+		blockFile.Close()
+		os.Remove(blockFile.Name())
+		return
+	}
+	if err = blockFile.Close(); err != nil {
+		log.Printf("handleBlock blockFile.Close: %v", err)
+	}
+	if written != fileSize {
+		log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
+		os.Remove(blockFile.Name())
+		p2pPeerScores.Penalize(p2pc, p2pPenaltySizeMismatch, "block size mismatch")
+		metricsBlocksRejected.Inc("size_mismatch")
+		return
+	}
+	fileHash, err := hashFileToHexString(blockFile.Name())
+	if err != nil || fileHash != hash {
+		log.Println("Error decoding block: hashes don't match:", fileHash, "vs", hash)
+		os.Remove(blockFile.Name())
+		p2pPeerScores.Penalize(p2pc, p2pPenaltyInvalidBlock, "block hash mismatch")
+		metricsBlocksRejected.Inc("hash_mismatch")
+		return
+	}
+	p2pc.deliverBlock(hash, hashSignature, blockFile.Name())
+}
+
+// Asks the peer to send the block inline, after its block URL couldn't be downloaded. This is
+// done only once per block, so if a peer doesn't understand the request, the sync manager
+// requests the block from another peer.
+func (p2pc *p2pConnection) blockURLFailedFallback(hash string) {
+	if p2pc.inlineRequested[hash] {
+		return
+	}
+	if p2pc.inlineRequested == nil {
+		p2pc.inlineRequested = make(map[string]bool)
+	}
+	p2pc.inlineRequested[hash] = true
+	log.Println("Asking", p2pc.address, "to send block", hash, "inline")
+	// Called from the connection's goroutine, which also drains chanToPeer, so write directly
+	err := p2pc.sendMsg(p2pMsgGetBlockStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetBlock,
+		},
+		Hash:   hash,
+		Inline: true,
+	})
+	if err != nil {
+		log.Println("Error requesting block", hash, "from", p2pc.address, err)
+	}
+}
+
+// Hands a received and hash-verified block file over to the sync manager
+func (p2pc *p2pConnection) deliverBlock(hash string, hashSignature string, fileName string) {
+	delete(p2pc.inlineRequested, hash)
+	hashSignatureBytes, err := hex.DecodeString(hashSignature)
 	if err != nil {
 		log.Println("Error decoding hash signature", p2pc.conn, err)
+		os.Remove(fileName)
 		return
 	}
-	height, err := checkAcceptBlock(blk)
+	p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlBlockReceived, payload: &syncReceivedBlock{
+		hash:          hash,
+		hashSignature: hashSignatureBytes,
+		fileName:      fileName,
+		peer:          p2pc,
+	}}
+}
+
+// getblockchunk: a request for a part of a block
+func (p2pc *p2pConnection) handleGetBlockChunk(msg StrIfMap) {
+	hash, err := msg.GetString("hash")
 	if err != nil {
-		log.Println("Cannot import block:", err)
+		log.Println(p2pc.conn, err)
 		return
 	}
-	blk.Height = height
-	blk.DbBlockchainBlock.TimeAccepted = time.Now()
-	err = blockchainCopyFile(blockFile.Name(), height)
+	offset, err := msg.GetInt64("offset")
 	if err != nil {
-		log.Println("Cannot copy block file:", err)
+		log.Println(p2pc.conn, err)
+		return
+	}
+	length, err := msg.GetInt64("length")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if offset < 0 || length < 1 || length > cfg.P2pChunkSize {
+		log.Println("Invalid chunk request from", p2pc.address, offset, length)
+		return
+	}
+	dbb, err := dbGetBlock(hash)
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	data, err := blockFileReadChunk(blockchainGetFilename(dbb.Height), offset, length)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = p2pc.sendMsg(p2pMsgBlockChunkStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgBlockChunk,
+		},
+		Hash:      hash,
+		Offset:    offset,
+		ChunkHash: hashBytesToHexString(data),
+		Data:      base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		log.Println("Error sending chunk of block", hash, "to", p2pc.address, err)
+	}
+}
+
+// blockchunk: a part of a block is received
+func (p2pc *p2pConnection) handleBlockChunk(msg StrIfMap) {
+	hash, err := msg.GetString("hash")
+	if err != nil {
+		log.Println(p2pc.conn, err)
 		return
 	}
-	err = dbInsertBlock(blk.DbBlockchainBlock)
+	offset, err := msg.GetInt64("offset")
 	if err != nil {
-		log.Println("Cannot insert block:", err)
+		log.Println(p2pc.conn, err)
 		return
 	}
-	log.Println("Accepted block", blk.Hash, "at height", blk.Height)
-	blk.Close()
+	dataString, err := msg.GetString("data")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(dataString)
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	p2pc.receiveBlockChunk(hash, offset, data)
 }
 
 // Connect to a peer. Does everything except starting the handler goroutine.
@@ -752,27 +1381,33 @@ func p2pConnectPeer(address string) (*p2pConnection, error) {
 		return nil, fmt.Errorf("Connection to %s already exists", addr.String())
 	}
 
-	localAddresses := getLocalAddresses()
-	if inStrings(addr.IP.String(), localAddresses) {
-		return nil, fmt.Errorf("Refusing to connect to myself at %s", addr.IP)
+	if p2pIsBanned(address) {
+		return nil, fmt.Errorf("Peer %s is banned", address)
+	}
+
+	if p2pIsMyAddress(addr) {
+		return nil, fmt.Errorf("Refusing to connect to myself at %s", addr)
 	}
 
-	conn, err := net.Dial("tcp", address)
+	conn, err := p2pDial(address)
 	if err != nil {
 		log.Println("Error connecting to", address, err)
+		dbRecordPeerFailure(address)
+		p2pConnMgr.Failed(address)
 		return nil, err
 	}
-	return p2pSetupPeer(address, conn)
+	return p2pSetupPeer(address, conn, true)
 }
 
 // Creates the p2pConnection structure for the peer and adds it to the peer list.
 // Does not start the handler goroutine.
-func p2pSetupPeer(address string, conn net.Conn) (*p2pConnection, error) {
+func p2pSetupPeer(address string, conn net.Conn, outbound bool) (*p2pConnection, error) {
 	p2pc := p2pConnection{
 		conn:         conn,
 		address:      address,
+		outbound:     outbound,
 		chanToPeer:   make(chan interface{}, 5),
-		chanFromPeer: make(chan StrIfMap, 5),
+		chanFromPeer: make(chan StrIfMap, cfg.P2pQueueSize),
 	}
 	p2pPeers.Add(&p2pc)
 	return &p2pc, nil
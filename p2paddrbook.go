@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// The address book is the peers table: it remembers where each peer address came from and how
+// outgoing connections to it have gone, so the best peers are tried first and dead addresses
+// are eventually forgotten. Permanent (bootstrap) peers are never forgotten.
+
+// Where a saved peer address came from
+const (
+	p2pPeerSourceBootstrap = "bootstrap" // the chain params or the built-in list
+	p2pPeerSourceGossip    = "gossip"    // another peer's my_peers
+	p2pPeerSourceInbound   = "inbound"   // a peer which connected to us and accepts connections
+	p2pPeerSourceLAN       = "lan"       // LAN discovery
+)
+
+// Addresses which have failed this many times and haven't worked for addrBookEvictAge are forgotten
+const addrBookEvictFailures = 10
+const addrBookEvictAge = 7 * 24 * time.Hour
+
+// Returns the quality of the peer address, between 0 and 1: the ratio of successful connections
+// (with an unknown address counting as half successful), reduced for addresses which haven't
+// worked for a long time and for slow peers.
+func addrBookQuality(dbp *DbPeer) float64 {
+	q := float64(dbp.SuccessCount+1) / float64(dbp.SuccessCount+dbp.FailureCount+2)
+	if !dbp.TimeLastSuccess.IsZero() {
+		days := time.Since(dbp.TimeLastSuccess).Hours() / 24
+		q *= math.Pow(0.9, days)
+	}
+	if dbp.Latency > 0 {
+		q /= 1 + dbp.Latency.Seconds()
+	}
+	return q
+}
+
+// Returns the saved peer addresses which could be connected to, best first. Addresses which
+// are connected, bad or banned are skipped.
+func addrBookCandidates() []string {
+	var candidates []DbPeer
+	for _, dbp := range dbGetPeers() {
+		if p2pPeers.HasAddress(dbp.Address) || p2pCoordinator.badPeers.Has(dbp.Address) || p2pIsBanned(dbp.Address) {
+			continue
+		}
+		candidates = append(candidates, dbp)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return addrBookQuality(&candidates[i]) > addrBookQuality(&candidates[j])
+	})
+	addresses := make([]string, len(candidates))
+	for i := range candidates {
+		addresses[i] = candidates[i].Address
+	}
+	return addresses
+}
+
+// Forgets the non-permanent peer addresses which keep failing and haven't worked for a long time
+func addrBookEvictDead() {
+	for _, dbp := range dbGetPeers() {
+		if dbp.Permanent || dbp.FailureCount < addrBookEvictFailures {
+			continue
+		}
+		if time.Since(dbp.TimeLastSuccess) < addrBookEvictAge || time.Since(dbp.TimeLastSeen) < addrBookEvictAge {
+			continue
+		}
+		log.Println("Forgetting dead peer", dbp.Address, "after", dbp.FailureCount, "failures")
+		dbDeletePeer(dbp.Address)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Large blocks are transferred in chunks. The sender answers getblock with a list of chunk hashes,
+// and the receiver requests the chunks one by one, verifying each against the list. The partial
+// block is kept in the downloads subdirectory of the data directory, so when the transfer is
+// interrupted, the chunks which are already there are verified and kept the next time the block
+// is requested, from the same or from another peer.
+
+const downloadsSubdirectoryBaseName = "downloads"
+
+// How many chunk requests are outstanding at a time, per block
+const p2pChunkWindow = 2
+
+// A block being downloaded in chunks
+type blockDownload struct {
+	hash          string
+	hashSignature string
+	size          int64
+	chunkSize     int64
+	chunkHashes   []string
+	received      []bool
+	remaining     int
+	nextChunk     int // the next chunk to request
+	peer          *p2pConnection
+	lastActivity  time.Time
+}
+
+// Blocks currently being downloaded in chunks, by hash. The peer which most recently sent
+// the list of chunk hashes for a block owns the download; chunks from other peers are ignored.
+type blockDownloadsType struct {
+	downloads map[string]*blockDownload
+	lock      WithMutex
+}
+
+var blockDownloads = blockDownloadsType{downloads: make(map[string]*blockDownload)}
+
+// Returns the directory where blocks being downloaded are kept, creating it if needed
+func blockDownloadsDir() (string, error) {
+	dir := fmt.Sprintf("%s/%s", cfg.DataDir, downloadsSubdirectoryBaseName)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// Block hashes are hex-encoded SHA-256 hashes. Hashes received from peers must be checked
+// before they are used in file names.
+var blockHashRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Returns the filename of the partially downloaded block with the given hash
+func blockDownloadGetFilename(hash string) string {
+	return fmt.Sprintf("%s/%s/%s.part", cfg.DataDir, downloadsSubdirectoryBaseName, hash)
+}
+
+// Creates a temporary file for a block which is received in one piece
+func blockDownloadTempFile() (*os.File, error) {
+	dir, err := blockDownloadsDir()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "block-*.tmp")
+}
+
+// Returns the number of chunks of the given size a block of the given size consists of
+func blockChunkCount(size, chunkSize int64) int {
+	return int((size + chunkSize - 1) / chunkSize)
+}
+
+// Returns the hashes of the chunks of the given file
+func blockFileChunkHashes(fileName string, chunkSize int64) ([]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("blockFileChunkHashes f.Close: %v", err)
+		}
+	}()
+	var hashes []string
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			hashes = append(hashes, hashBytesToHexString(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads a chunk of the given file
+func blockFileReadChunk(fileName string, offset int64, length int64) ([]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("blockFileReadChunk f.Close: %v", err)
+		}
+	}()
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Returns the length of the chunk with the given index
+func (d *blockDownload) chunkLength(i int) int64 {
+	if rest := d.size - int64(i)*d.chunkSize; rest < d.chunkSize {
+		return rest
+	}
+	return d.chunkSize
+}
+
+// Starts (or resumes) downloading a block in chunks from the peer. Chunks already present in the
+// partially downloaded file are verified and kept.
+func (p2pc *p2pConnection) startBlockDownload(hash string, hashSignature string, size int64, chunkSize int64, chunkHashes []string) error {
+	if !blockHashRegexp.MatchString(hash) {
+		return fmt.Errorf("invalid block hash %q", hash)
+	}
+	if _, err := blockDownloadsDir(); err != nil {
+		return err
+	}
+	d := &blockDownload{
+		hash:          hash,
+		hashSignature: hashSignature,
+		size:          size,
+		chunkSize:     chunkSize,
+		chunkHashes:   chunkHashes,
+		received:      make([]bool, len(chunkHashes)),
+		remaining:     len(chunkHashes),
+		peer:          p2pc,
+		lastActivity:  time.Now(),
+	}
+	fileName := blockDownloadGetFilename(hash)
+	if st, err := os.Stat(fileName); err == nil {
+		for i := range chunkHashes {
+			offset := int64(i) * chunkSize
+			if offset+d.chunkLength(i) > st.Size() {
+				break
+			}
+			data, err := blockFileReadChunk(fileName, offset, d.chunkLength(i))
+			if err != nil {
+				break
+			}
+			if hashBytesToHexString(data) == chunkHashes[i] {
+				d.received[i] = true
+				d.remaining--
+			}
+		}
+		if d.remaining < len(chunkHashes) {
+			log.Printf("Resuming download of block %s, %d of %d chunks already present", hash, len(chunkHashes)-d.remaining, len(chunkHashes))
+		}
+	}
+	if err := os.Truncate(fileName, size); err != nil {
+		f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(size)
+		if cerr := f.Close(); cerr != nil {
+			log.Printf("startBlockDownload f.Close: %v", cerr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	blockDownloads.lock.With(func() {
+		blockDownloads.downloads[hash] = d
+	})
+	if d.remaining == 0 {
+		p2pc.finishBlockDownload(d)
+		return nil
+	}
+	for i := 0; i < p2pChunkWindow; i++ {
+		p2pc.requestNextChunk(d)
+	}
+	return nil
+}
+
+// Requests the next chunk of the block which hasn't been received yet, if any
+func (p2pc *p2pConnection) requestNextChunk(d *blockDownload) {
+	for d.nextChunk < len(d.chunkHashes) && d.received[d.nextChunk] {
+		d.nextChunk++
+	}
+	if d.nextChunk >= len(d.chunkHashes) {
+		return
+	}
+	// Called from the connection's goroutine, which also drains chanToPeer, so write directly
+	err := p2pc.sendMsg(p2pMsgGetBlockChunkStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetBlockChunk,
+		},
+		Hash:   d.hash,
+		Offset: int64(d.nextChunk) * d.chunkSize,
+		Length: d.chunkLength(d.nextChunk),
+	})
+	if err != nil {
+		log.Println("Error requesting chunk of block", d.hash, "from", p2pc.address, err)
+		return
+	}
+	d.nextChunk++
+}
+
+// Writes a received chunk into the partially downloaded block, and hands the block over to the
+// sync manager when all the chunks have been received.
+func (p2pc *p2pConnection) receiveBlockChunk(hash string, offset int64, data []byte) {
+	var d *blockDownload
+	blockDownloads.lock.With(func() {
+		d = blockDownloads.downloads[hash]
+	})
+	if d == nil || d.peer != p2pc {
+		log.Println("Ignoring unexpected chunk of block", hash, "from", p2pc.address)
+		return
+	}
+	i := int(offset / d.chunkSize)
+	if offset < 0 || offset%d.chunkSize != 0 || i >= len(d.chunkHashes) || d.received[i] {
+		log.Println("Ignoring chunk at unexpected offset", offset, "of block", hash, "from", p2pc.address)
+		return
+	}
+	if int64(len(data)) != d.chunkLength(i) || hashBytesToHexString(data) != d.chunkHashes[i] {
+		log.Println("Chunk at offset", offset, "of block", hash, "from", p2pc.address, "doesn't match its hash")
+		p2pc.abortBlockDownload(d)
+		p2pPeerScores.Penalize(p2pc, p2pPenaltySizeMismatch, "chunk hash mismatch")
+		return
+	}
+	f, err := os.OpenFile(blockDownloadGetFilename(hash), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Error opening partial block", hash, err)
+		p2pc.abortBlockDownload(d)
+		return
+	}
+	_, err = f.WriteAt(data, offset)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println("Error writing partial block", hash, err)
+		p2pc.abortBlockDownload(d)
+		return
+	}
+	d.received[i] = true
+	d.remaining--
+	blockDownloads.lock.With(func() {
+		d.lastActivity = time.Now()
+	})
+	if d.remaining == 0 {
+		p2pc.finishBlockDownload(d)
+		return
+	}
+	p2pc.requestNextChunk(d)
+}
+
+// Verifies the completely downloaded block and hands it over to the sync manager
+func (p2pc *p2pConnection) finishBlockDownload(d *blockDownload) {
+	p2pc.abortBlockDownload(d)
+	fileName := blockDownloadGetFilename(d.hash)
+	fileHash, err := hashFileToHexString(fileName)
+	if err != nil || fileHash != d.hash {
+		log.Println("Error downloading block: hashes don't match:", fileHash, "vs", d.hash)
+		removeFile(fileName)
+		p2pPeerScores.Penalize(p2pc, p2pPenaltyInvalidBlock, "block hash mismatch")
+		metricsBlocksRejected.Inc("hash_mismatch")
+		return
+	}
+	p2pc.deliverBlock(d.hash, d.hashSignature, fileName)
+}
+
+// Stops tracking the download of a block; the partially downloaded file is kept for resuming
+func (p2pc *p2pConnection) abortBlockDownload(d *blockDownload) {
+	blockDownloads.lock.With(func() {
+		if blockDownloads.downloads[d.hash] == d {
+			delete(blockDownloads.downloads, d.hash)
+		}
+	})
+}
+
+// Stops tracking all the downloads from the peer, when it disconnects
+func (p2pc *p2pConnection) releaseBlockDownloads() {
+	blockDownloads.lock.With(func() {
+		for hash, d := range blockDownloads.downloads {
+			if d.peer == p2pc {
+				delete(blockDownloads.downloads, hash)
+			}
+		}
+	})
+}
+
+// Returns true if the peer has recently sent a chunk of the block, i.e. the download is progressing
+func blockDownloadActive(hash string, p2pc *p2pConnection, timeout time.Duration) bool {
+	active := false
+	blockDownloads.lock.With(func() {
+		d, ok := blockDownloads.downloads[hash]
+		active = ok && d.peer == p2pc && time.Since(d.lastActivity) < timeout
+	})
+	return active
+}
+
+// Removes abandoned partially downloaded blocks and temporary files
+func blockDownloadsPrune() {
+	dir := fmt.Sprintf("%s/%s", cfg.DataDir, downloadsSubdirectoryBaseName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if time.Since(fi.ModTime()) < orphanMaxAge {
+			continue
+		}
+		hash := strings.TrimSuffix(fi.Name(), ".part")
+		active := false
+		blockDownloads.lock.With(func() {
+			_, active = blockDownloads.downloads[hash]
+		})
+		if active {
+			continue
+		}
+		log.Println("Discarding abandoned download", fi.Name())
+		removeFile(filepath.Join(dir, fi.Name()))
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// The connection manager keeps the number of outgoing connections at the configured target,
+// dialling the best addresses from the address book. Addresses which fail are retried with
+// exponential backoff, and at most p2pMaxOutboundPerSubnet outgoing connections go to the same
+// subnet, so that a single network can't easily surround the node. Loopback and private
+// addresses are exempt from the subnet limit, so lab setups with many nodes still work.
+
+// The delay after the first failed connection to an address, doubled for each following one
+const p2pConnMgrBaseBackoff = 30 * time.Second
+const p2pConnMgrMaxBackoff = time.Hour
+
+// How many outgoing connections may go to the same subnet (IPv4 /16 or IPv6 /32)
+const p2pMaxOutboundPerSubnet = 1
+
+// How many addresses from a peer's my_peers are added to the address book
+const p2pMaxGossipAddresses = 100
+
+type p2pBackoff struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+type p2pConnMgrType struct {
+	backoff map[string]*p2pBackoff // failing addresses
+	dialing map[string]string      // addresses being dialled, with their subnet groups
+	lock    WithMutex
+}
+
+var p2pConnMgr = p2pConnMgrType{
+	backoff: make(map[string]*p2pBackoff),
+	dialing: make(map[string]string),
+}
+
+// Returns the subnet group of the address, used to spread outgoing connections over networks, or
+// an empty string for loopback and private addresses. Host names are their own group.
+func p2pSubnetGroup(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
+
+// Failed records a failed connection to the address, delaying the next attempt
+func (cm *p2pConnMgrType) Failed(address string) {
+	cm.lock.With(func() {
+		b, ok := cm.backoff[address]
+		if !ok {
+			b = &p2pBackoff{}
+			cm.backoff[address] = b
+		}
+		b.failures++
+		delay := p2pConnMgrBaseBackoff
+		for i := 1; i < b.failures && delay < p2pConnMgrMaxBackoff; i++ {
+			delay *= 2
+		}
+		if delay > p2pConnMgrMaxBackoff {
+			delay = p2pConnMgrMaxBackoff
+		}
+		b.nextAttempt = time.Now().Add(delay)
+	})
+}
+
+// Succeeded records a successful connection to the address
+func (cm *p2pConnMgrType) Succeeded(address string) {
+	cm.lock.With(func() {
+		delete(cm.backoff, address)
+	})
+}
+
+// Marks the address as being dialled, unless it's already being dialled or is backing off
+func (cm *p2pConnMgrType) startDial(address string, group string) bool {
+	ok := false
+	cm.lock.With(func() {
+		if _, dialing := cm.dialing[address]; dialing {
+			return
+		}
+		if b, backingOff := cm.backoff[address]; backingOff && time.Now().Before(b.nextAttempt) {
+			return
+		}
+		cm.dialing[address] = group
+		ok = true
+	})
+	return ok
+}
+
+// Connects to the address and starts handling the connection
+func (cm *p2pConnMgrType) dial(address string) {
+	defer cm.lock.With(func() {
+		delete(cm.dialing, address)
+	})
+	p2pc, err := p2pConnectPeer(address)
+	if err != nil {
+		return
+	}
+	go p2pc.handleConnection()
+}
+
+// Maintain dials the best addresses from the address book until there are enough outgoing
+// connections (including the ones being dialled).
+func (cm *p2pConnMgrType) Maintain() {
+	outbound := 0
+	groups := make(map[string]int)
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if !p2pc.outbound {
+				continue
+			}
+			outbound++
+			if g := p2pSubnetGroup(p2pc.address); g != "" {
+				groups[g]++
+			}
+		}
+	})
+	cm.lock.With(func() {
+		for _, g := range cm.dialing {
+			outbound++
+			if g != "" {
+				groups[g]++
+			}
+		}
+	})
+	if outbound >= cfg.P2pTargetOutbound {
+		return
+	}
+	for _, address := range addrBookCandidates() {
+		if outbound >= cfg.P2pTargetOutbound {
+			break
+		}
+		g := p2pSubnetGroup(address)
+		if g != "" && groups[g] >= p2pMaxOutboundPerSubnet {
+			continue
+		}
+		if !cm.startDial(address, g) {
+			continue
+		}
+		outbound++
+		if g != "" {
+			groups[g]++
+		}
+		log.Println("Connecting to", address)
+		go cm.dial(address)
+	}
+}
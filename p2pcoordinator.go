@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net"
 	"time"
@@ -12,6 +11,12 @@ const (
 	p2pCtrlSearchForBlocks = iota
 	p2pCtrlHaveNewBlock
 	p2pCtrlConnectPeers
+	p2pCtrlBlockHashes
+	p2pCtrlBlockReceived
+	p2pCtrlHeaders
+	p2pCtrlLANPeer
+	p2pCtrlKeyOps
+	p2pCtrlFetchBlock
 )
 
 type p2pCtrlMessage struct {
@@ -25,25 +30,31 @@ var p2pCtrlChannel = make(chan p2pCtrlMessage, 8)
 // single-threaded object, its fields and methods are only expected to be accessed from
 // the Run() goroutine.
 type p2pCoordinatorType struct {
-	timeTicks                chan int
-	lastTickBlockchainHeight int
-	recentlyRequestedBlocks  *StringSetWithExpiry
-	lastReconnectTime        time.Time
-	badPeers                 *StringSetWithExpiry
+	timeTicks           chan int
+	lastAnnouncedHeight int // blocks up to this height have been announced to peers
+	lastReconnectTime   time.Time
+	badPeers            *StringSetWithExpiry
+	sync                *syncManager
 }
 
 // XXX: singletons in go?
 var p2pCoordinator = p2pCoordinatorType{
-	recentlyRequestedBlocks: NewStringSetWithExpiry(5 * time.Second),
-	lastReconnectTime:       time.Now(),
-	timeTicks:               make(chan int),
-	badPeers:                NewStringSetWithExpiry(15 * time.Minute),
+	lastReconnectTime: time.Now(),
+	timeTicks:         make(chan int),
+	badPeers:          NewStringSetWithExpiry(15 * time.Minute),
+	sync:              newSyncManager(),
 }
 
 func (co *p2pCoordinatorType) Run() {
-	co.lastTickBlockchainHeight = dbGetBlockchainHeight()
+	co.lastAnnouncedHeight = dbGetBlockchainHeight()
+	blockEvents := eventBus.Subscribe(busEventBlockAccepted, 64)
+	defer eventBus.Unsubscribe(blockEvents)
+	// Orphan blocks kept from the previous run might extend the blockchain
+	co.sync.connectOrphans(dbGetBlockHashByHeight(co.lastAnnouncedHeight))
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
+	syncTicker := time.NewTicker(1 * time.Second)
+	defer syncTicker.Stop()
 	for {
 		select {
 		case msg := <-p2pCtrlChannel:
@@ -52,16 +63,40 @@ func (co *p2pCoordinatorType) Run() {
 				co.handleSearchForBlocks(msg.payload.(*p2pConnection))
 			case p2pCtrlConnectPeers:
 				co.handleConnectPeers(msg.payload.([]string))
+			case p2pCtrlLANPeer:
+				co.handleLANPeer(msg.payload.(string))
+			case p2pCtrlBlockHashes:
+				co.sync.handleBlockHashes(msg.payload.(*syncBlockHashes))
+			case p2pCtrlHeaders:
+				co.sync.handleHeaders(msg.payload.(*syncHeaders))
+			case p2pCtrlBlockReceived:
+				co.sync.handleBlockReceived(msg.payload.(*syncReceivedBlock))
+			case p2pCtrlKeyOps:
+				co.sync.handleKeyOps(msg.payload.(*syncKeyOps))
+			case p2pCtrlFetchBlock:
+				co.sync.handleFetchBlock(msg.payload.(*syncFetchRequest))
 			}
+		case ev := <-blockEvents:
+			dbb := ev.payload.(*DbBlockchainBlock)
+			co.announceBlocks(map[int]string{dbb.Height: dbb.Hash})
+		case <-syncTicker.C:
+			co.sync.checkTimeouts()
+			metricsSyncPendingBlocks.Set(float64(len(co.sync.wanted)))
+			metricsSyncInFlightBlocks.Set(float64(len(co.sync.inFlight)))
 		case <-ticker.C:
 			co.handleTimeTick()
 		}
 	}
 }
 
-// Retrieves block hashes from a node which apparently has more blocks than we do.
-// ToDo: This is a simplistic version. Make it better by introducing quorums.
+// Starts searching for blocks when a node apparently has more blocks than we do. Headers are requested
+// from all the peers which support them, and the sync manager downloads the blocks a quorum of peers
+// agrees on. Peers which don't support headers are asked for block hashes, which count only as votes.
 func (co *p2pCoordinatorType) handleSearchForBlocks(p2pcStart *p2pConnection) {
+	if p2pcStart.hasCapability(p2pCapHeaders) {
+		co.sync.requestHeaders()
+		return
+	}
 	msg := p2pMsgGetBlockHashesStruct{
 		p2pMsgHeader: p2pMsgHeader{
 			P2pID: p2pEphemeralID,
@@ -69,67 +104,90 @@ func (co *p2pCoordinatorType) handleSearchForBlocks(p2pcStart *p2pConnection) {
 			Msg:   p2pMsgGetBlockHashes,
 		},
 		MinBlockHeight: dbGetBlockchainHeight(),
-		MaxBlockHeight: p2pcStart.chainHeight,
+		MaxBlockHeight: p2pcStart.getChainHeight(),
+	}
+	select {
+	case p2pcStart.chanToPeer <- msg:
+		log.Printf("Searching for blocks from %d to %d", msg.MinBlockHeight, msg.MaxBlockHeight)
+	default:
+		log.Println("Queue to", p2pcStart.address, "is full, not searching for blocks")
 	}
-	log.Printf("Searching for blocks from %d to %d", msg.MinBlockHeight, msg.MaxBlockHeight)
-	p2pcStart.chanToPeer <- msg
 }
 
+// Adds the peer addresses received from a peer to the address book. The connection manager
+// decides which of them to connect to.
 func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
-	localAddresses := getLocalAddresses()
-
+	if len(addresses) > p2pMaxGossipAddresses {
+		addresses = addresses[:p2pMaxGossipAddresses]
+	}
 	for _, address := range addresses {
-		host, _, err := splitAddress(address)
-		if err != nil {
-			log.Println(address, err)
-			continue
-		}
-		canonicalAddress := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
-		if p2pPeers.HasAddress(canonicalAddress) || co.badPeers.Has(canonicalAddress) {
-			continue
-		}
+		// Peers send the addresses other nodes accept connections on, including the port
+		canonicalAddress := p2pAddressWithPort(address)
 		addr, err := net.ResolveTCPAddr("tcp", canonicalAddress)
 		if err != nil {
 			continue
 		}
-		if inStrings(addr.IP.String(), localAddresses) {
+		if p2pIsMyAddress(addr) || p2pIsBanned(canonicalAddress) {
 			continue
 		}
-		// Detect if there's a canonical peer on the other side, somewhat brute-forceish
-		conn, err := net.DialTCP("tcp", nil, addr)
-		if err != nil {
-			return
-		}
-		p2pc, err := p2pSetupPeer(addr.String(), conn)
-		if err != nil {
-			log.Println("handleConnectPeers:", err)
-			continue
-		}
-		go p2pc.handleConnection()
-		log.Println("Detected canonical peer at", canonicalAddress)
-		dbSavePeer(canonicalAddress)
+		dbSavePeer(canonicalAddress, p2pPeerSourceGossip)
 	}
+	p2pConnMgr.Maintain()
+}
+
+// Adds a peer found by LAN discovery to the address book, and connects to it if more
+// connections are needed.
+func (co *p2pCoordinatorType) handleLANPeer(address string) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || p2pIsMyAddress(addr) || p2pIsBanned(address) {
+		return
+	}
+	dbSavePeer(address, p2pPeerSourceLAN)
+	p2pConnMgr.Maintain()
 }
 
 // Executed periodically to perform time-dependant actions. Do not rely on the
 // time period to be predictable or precise.
 func (co *p2pCoordinatorType) handleTimeTick() {
+	// Blocks can also be added by other processes (the command line actions), which don't publish
+	// events to this one, or the events might have been dropped.
 	newHeight := dbGetBlockchainHeight()
-	if newHeight > co.lastTickBlockchainHeight {
+	if newHeight > co.lastAnnouncedHeight {
 		log.Println("New blocks detected. New max height:", newHeight)
-		co.floodPeersWithNewBlocks(co.lastTickBlockchainHeight, newHeight)
-		co.lastTickBlockchainHeight = newHeight
+		co.announceBlocks(dbGetHeightHashes(co.lastAnnouncedHeight+1, newHeight))
 	}
 	if time.Since(co.lastReconnectTime) >= 10*time.Minute {
 		co.lastReconnectTime = time.Now()
 		p2pPeers.saveConnectablePeers()
-		co.connectDbPeers()
+		addrBookEvictDead()
 	}
+	p2pConnMgr.Maintain()
 	p2pPeers.tryPeersConnectable()
+	p2pPeerScores.Recover(1)
+	orphanPrune()
+	blockDownloadsPrune()
 }
 
-func (co *p2pCoordinatorType) floodPeersWithNewBlocks(minHeight, maxHeight int) {
-	blockHashes := dbGetHeightHashes(minHeight, maxHeight)
+// Announces the blocks to the peers which don't have them yet, as far as we know. Peers whose
+// queues are full are skipped rather than blocking the coordinator.
+func (co *p2pCoordinatorType) announceBlocks(blockHashes map[int]string) {
+	maxHeight := 0
+	for h := range blockHashes {
+		if h > maxHeight {
+			maxHeight = h
+		}
+	}
+	if maxHeight > co.lastAnnouncedHeight {
+		co.lastAnnouncedHeight = maxHeight
+	}
+	var peers []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc.helloReceived && p2pc.chainHeight < maxHeight {
+				peers = append(peers, p2pc)
+			}
+		}
+	})
 	msg := p2pMsgBlockHashesStruct{
 		p2pMsgHeader: p2pMsgHeader{
 			P2pID: p2pEphemeralID,
@@ -138,26 +196,11 @@ func (co *p2pCoordinatorType) floodPeersWithNewBlocks(minHeight, maxHeight int)
 		},
 		Hashes: blockHashes,
 	}
-	p2pPeers.lock.With(func() {
-		for p2pc := range p2pPeers.peers {
-			p2pc.chanToPeer <- msg
-		}
-	})
-}
-
-func (co *p2pCoordinatorType) connectDbPeers() {
-	peers := dbGetSavedPeers()
-	for peer := range peers {
-		if p2pPeers.HasAddress(peer) {
-			continue
-		}
-		if co.badPeers.Has(peer) {
-			continue
-		}
-		p2pc, err := p2pConnectPeer(peer)
-		if err != nil {
-			continue
+	for _, p2pc := range peers {
+		select {
+		case p2pc.chanToPeer <- msg:
+		default:
+			log.Println("Queue to", p2pc.address, "is full, not announcing blocks up to", maxHeight)
 		}
-		go p2pc.handleConnection()
 	}
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// LAN discovery lets nodes on isolated networks find each other without bootstrap peers. When
+// enabled, each node periodically sends a small JSON announcement with the chain root hash, its
+// p2p port and its ephemeral ID to a UDP multicast (or broadcast) address, and adds the nodes
+// it hears from which are on the same chain to the address book.
+
+// DefaultLANDiscoveryAddress is the default UDP address LAN announcements are sent to
+const DefaultLANDiscoveryAddress = "239.255.20.17:2019"
+
+// How often the node announces itself on the LAN
+const lanAnnounceInterval = 30 * time.Second
+
+// A node heard from is added to the address book again only after this long
+const lanSeenExpiry = 10 * time.Minute
+
+// The LAN announcement message
+const p2pMsgLANAnnounce = "lanannounce"
+
+type p2pMsgLANAnnounceStruct struct {
+	p2pMsgHeader
+	P2pPort int `json:"p2p_port"`
+}
+
+// Starts announcing this node on the LAN and listening for other nodes' announcements
+func lanDiscovery() {
+	groupAddr, err := net.ResolveUDPAddr("udp4", cfg.LanDiscoveryAddr)
+	if err != nil {
+		log.Println("Invalid LAN discovery address", cfg.LanDiscoveryAddr, err)
+		return
+	}
+	var conn *net.UDPConn
+	if groupAddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, groupAddr)
+	} else {
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: groupAddr.Port})
+	}
+	if err != nil {
+		log.Println("Cannot listen for LAN announcements on", cfg.LanDiscoveryAddr, err)
+		return
+	}
+	log.Println("LAN discovery on", cfg.LanDiscoveryAddr)
+	go lanAnnounce(groupAddr)
+	lanListen(conn)
+}
+
+// Periodically sends the announcement
+func lanAnnounce(groupAddr *net.UDPAddr) {
+	msg, err := json.Marshal(p2pMsgLANAnnounceStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgLANAnnounce,
+		},
+		P2pPort: cfg.P2pPort,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	conn, err := net.DialUDP("udp4", nil, groupAddr)
+	if err != nil {
+		log.Println("Cannot send LAN announcements to", groupAddr, err)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("lanAnnounce conn.Close: %v", err)
+		}
+	}()
+	for {
+		if _, err = conn.Write(msg); err != nil {
+			log.Println("Error sending LAN announcement:", err)
+		}
+		time.Sleep(lanAnnounceInterval)
+	}
+}
+
+// Receives announcements and passes the addresses of nodes on the same chain to the coordinator
+func lanListen(conn *net.UDPConn) {
+	seen := NewStringSetWithExpiry(lanSeenExpiry)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("Error receiving LAN announcement:", err)
+			return
+		}
+		var msg StrIfMap
+		if err = json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		if cmd, err := msg.GetString("msg"); err != nil || cmd != p2pMsgLANAnnounce {
+			continue
+		}
+		if root, err := msg.GetString("root"); err != nil || root != chainParams.GenesisBlockHash {
+			continue
+		}
+		peerID, err := msg.GetInt64("p2p_id")
+		if err != nil || peerID == p2pEphemeralID {
+			continue
+		}
+		port, err := msg.GetInt("p2p_port")
+		if err != nil || port < 1 || port > 65535 {
+			continue
+		}
+		address := net.JoinHostPort(from.IP.String(), strconv.Itoa(port))
+		if seen.Has(address) {
+			continue
+		}
+		seen.Add(address)
+		log.Printf("Found peer %s (%x) on the LAN", address, peerID)
+		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlLANPeer, payload: address}
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Light nodes don't download and store the blocks. They sync the block headers like full nodes
+// do, and instead of the blocks they ask their peers for the blocks' key ops, which are verified
+// against the keys valid at each block's height and applied to the keys in the main database, so
+// the following headers can be verified. The individual key ops are signed, so a peer can't forge
+// them, but the signatures only cover the public key hashes: a peer could leave key ops out, or
+// send key ops from another block. The key ops are therefore bound to the block's hash and only
+// used when the sync quorum of peers has sent the same key ops for the block.
+//
+// Light mode is recorded in the data directory, since its blockchain table lists blocks which
+// aren't stored.
+//
+// Blocks whose data is needed (e.g. to serve a table's rows over HTTP) are fetched from a peer
+// on demand. A fetched block's hash must match the signed header, and the block is kept in a
+// small cache in the lightcache subdirectory of the data directory.
+
+const lightCacheSubdirectoryBaseName = "lightcache"
+
+// How many fetched blocks are kept in the cache
+const lightCacheMaxBlocks = 16
+
+// How long to wait for a block being fetched on demand
+const lightFetchTimeout = 2 * time.Minute
+
+// The key in the config table which marks the data directory as a light node's
+const lightConfigKey = "light"
+
+// A request to fetch a block on demand, passed to the sync manager
+type syncFetchRequest struct {
+	height int
+	hash   string
+	reply  chan error
+}
+
+// A block being fetched on demand, and the callers waiting for it
+type syncFetch struct {
+	height        int
+	timeRequested time.Time
+	waiters       []chan error
+}
+
+// Tells the callers waiting for the block whether it has been fetched
+func (f *syncFetch) reply(err error) {
+	for _, w := range f.waiters {
+		w <- err
+	}
+}
+
+// Switches to light mode if the data directory belongs to a light node, and marks the data
+// directory as a light node's when starting in light mode. A full node's data directory with
+// blocks after the genesis block cannot be used in light mode.
+func lightInit() {
+	if dbGetConfig(lightConfigKey) == "1" {
+		if !cfg.Light {
+			log.Println("The data directory belongs to a light node, using light mode")
+			cfg.Light = true
+		}
+		return
+	}
+	if !cfg.Light {
+		return
+	}
+	if dbGetBlockchainHeight() > 0 {
+		log.Fatalln("The data directory belongs to a full node, it cannot be used in light mode")
+	}
+	dbSetConfig(lightConfigKey, "1")
+}
+
+// Returns the digest of the key ops of the block with the given hash, for counting the peers
+// which have sent the same key ops for the block
+func p2pKeyOpsDigest(hash string, ops []p2pKeyOp) string {
+	lines := make([]string, 0, len(ops))
+	for _, op := range ops {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s %s", op.Op, op.PublicKeyHash, op.PublicKey, op.SignatureKeyHash, op.Signature))
+	}
+	sort.Strings(lines)
+	return hashBytesToHexString([]byte(hash + "\n" + strings.Join(lines, "\n")))
+}
+
+// Records the key ops of the block sent by the peer
+func (bko *syncBlockKeyOps) add(peer *p2pConnection, digest string, keyOps map[string][]BlockKeyOp) {
+	if bko.votes[digest] == nil {
+		bko.votes[digest] = make(map[string]bool)
+		bko.keyOps[digest] = keyOps
+	}
+	if !bko.votes[digest][peer.peerKeyHash] {
+		bko.votes[digest][peer.peerKeyHash] = true
+		bko.peers[digest] = append(bko.peers[digest], peer)
+	}
+}
+
+// Returns the digest of the key ops which enough peers agree on, or an empty string
+func (bko *syncBlockKeyOps) agreed() string {
+	for digest, voters := range bko.votes {
+		if len(voters) >= cfg.SyncQuorum {
+			return digest
+		}
+	}
+	return ""
+}
+
+// Returns true if the peer has already sent key ops for the block
+func (bko *syncBlockKeyOps) hasSent(peer *p2pConnection) bool {
+	for _, voters := range bko.votes {
+		if voters[peer.peerKeyHash] {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts the key ops of a block into the form they're sent to peers in
+func p2pEncodeKeyOps(allKeyOps map[string][]BlockKeyOp) []p2pKeyOp {
+	result := []p2pKeyOp{}
+	for _, keyOps := range allKeyOps {
+		for _, keyOp := range keyOps {
+			result = append(result, p2pKeyOp{
+				Op:               keyOp.op,
+				PublicKeyHash:    keyOp.publicKeyHash,
+				PublicKey:        hex.EncodeToString(keyOp.publicKeyBytes),
+				SignatureKeyHash: keyOp.signatureKeyHash,
+				Signature:        hex.EncodeToString(keyOp.signature),
+			})
+		}
+	}
+	return result
+}
+
+// Converts the key ops of a block received from a peer into a map of public key hashes to lists
+// of ops, checking them the same way as the key ops read from a block file
+func p2pDecodeKeyOps(ops []p2pKeyOp) (map[string][]BlockKeyOp, error) {
+	allKeyOps := make(map[string][]BlockKeyOp)
+	for _, op := range ops {
+		keyOp := BlockKeyOp{op: op.Op, publicKeyHash: op.PublicKeyHash, signatureKeyHash: op.SignatureKeyHash}
+		var err error
+		if keyOp.publicKeyBytes, err = hex.DecodeString(op.PublicKey); err != nil {
+			return nil, err
+		}
+		publicKey, err := cryptoDecodePublicKeyBytes(keyOp.publicKeyBytes)
+		if err != nil {
+			return nil, err
+		}
+		if keyOp.publicKeyHash != cryptoMustGetPublicKeyHash(publicKey) {
+			return nil, fmt.Errorf("Public key hash doesn't match for %s", keyOp.publicKeyHash)
+		}
+		if keyOp.signature, err = hex.DecodeString(op.Signature); err != nil {
+			return nil, err
+		}
+		if others, ok := allKeyOps[keyOp.publicKeyHash]; ok && others[0].op != keyOp.op {
+			return nil, fmt.Errorf("Mixed key ops for a single public key %s", keyOp.publicKeyHash)
+		}
+		allKeyOps[keyOp.publicKeyHash] = append(allKeyOps[keyOp.publicKeyHash], keyOp)
+	}
+	return allKeyOps, nil
+}
+
+// getkeyops: a request for the key ops of blocks, from a light node
+func (p2pc *p2pConnection) handleGetKeyOps(msg StrIfMap) {
+	var minBlockHeight int
+	var maxBlockHeight int
+	var err error
+	if minBlockHeight, err = msg.GetInt("min_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if maxBlockHeight, err = msg.GetInt("max_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if cfg.Light {
+		log.Println("Light node, cannot send key ops to", p2pc.address)
+		return
+	}
+	if maxBlockHeight-minBlockHeight >= p2pMaxKeyOpsBlocks {
+		maxBlockHeight = minBlockHeight + p2pMaxKeyOpsBlocks - 1
+	}
+	if myHeight := dbGetBlockchainHeight(); maxBlockHeight > myHeight {
+		maxBlockHeight = myHeight
+	}
+	blocks := []p2pBlockKeyOps{}
+	for h := minBlockHeight; h <= maxBlockHeight; h++ {
+		b, err := OpenBlockByHeight(h)
+		if err != nil {
+			log.Println("Cannot open block", h, err)
+			break
+		}
+		keyOps, err := b.dbGetKeyOps()
+		if cerr := b.Close(); cerr != nil {
+			log.Printf("handleGetKeyOps b.Close: %v", cerr)
+		}
+		if err != nil {
+			log.Println("Cannot read key ops of block", h, err)
+			break
+		}
+		blocks = append(blocks, p2pBlockKeyOps{Height: h, Hash: b.Hash, KeyOps: p2pEncodeKeyOps(keyOps)})
+	}
+	log.Printf("*** Sending key ops of %d blocks from %d to %s", len(blocks), minBlockHeight, p2pc.address)
+	// Called from the connection's goroutine, which also drains chanToPeer, so write directly
+	err = p2pc.sendMsg(p2pMsgKeyOpsStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgKeyOps,
+		},
+		Blocks: blocks,
+	})
+	if err != nil {
+		log.Println("Error sending key ops to", p2pc.address, err)
+	}
+}
+
+// keyops: the key ops of blocks are received
+func (p2pc *p2pConnection) handleKeyOps(msg StrIfMap) {
+	var blocks []p2pBlockKeyOps
+	if err := msg.Decode("blocks", &blocks); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if len(blocks) > p2pMaxKeyOpsBlocks {
+		log.Println("Too many blocks' key ops from", p2pc.address)
+		return
+	}
+	p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlKeyOps, payload: &syncKeyOps{peer: p2pc, blocks: blocks}}
+}
+
+// Asks the peers for the key ops of the wanted blocks which are not yet requested or agreed on,
+// in runs of consecutive heights. Each run is requested from a peer which hasn't sent the key ops
+// of its first block yet.
+func (sm *syncManager) scheduleKeyOps(peers []*p2pConnection, load map[*p2pConnection]int) {
+	heights := []int{}
+	for h, hash := range sm.wanted {
+		if _, ok := sm.inFlight[hash]; ok {
+			continue
+		}
+		if bko, ok := sm.keyOps[hash]; ok && bko.agreed() != "" {
+			continue
+		}
+		heights = append(heights, h)
+	}
+	sort.Ints(heights)
+	for i := 0; i < len(heights); {
+		j := i + 1
+		for j < len(heights) && heights[j] == heights[j-1]+1 && j-i < p2pMaxKeyOpsBlocks {
+			j++
+		}
+		run := heights[i:j]
+		i = j
+		keyOpsPeers := []*p2pConnection{}
+		for _, p2pc := range peers {
+			if bko, ok := sm.keyOps[sm.wanted[run[0]]]; ok && bko.hasSent(p2pc) {
+				continue
+			}
+			if p2pc.hasCapability(p2pCapKeyOps) {
+				keyOpsPeers = append(keyOpsPeers, p2pc)
+			}
+		}
+		best := sm.choosePeer(sm.wanted[run[0]], run[len(run)-1], keyOpsPeers, load)
+		if best == nil {
+			continue
+		}
+		msg := p2pMsgGetKeyOpsStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pEphemeralID,
+				Root:  chainParams.GenesisBlockHash,
+				Msg:   p2pMsgGetKeyOps,
+			},
+			MinBlockHeight: run[0],
+			MaxBlockHeight: run[len(run)-1],
+		}
+		select {
+		case best.chanToPeer <- msg:
+		default:
+			// The peer's queue is full, don't block the coordinator
+			continue
+		}
+		log.Printf("Requesting key ops of blocks from %d to %d from %s", msg.MinBlockHeight, msg.MaxBlockHeight, best.address)
+		for _, h := range run {
+			hash := sm.wanted[h]
+			sm.inFlight[hash] = &syncRequest{hash: hash, height: h, peer: best, timeRequested: time.Now()}
+			sm.attempts[hash]++
+		}
+		load[best]++
+	}
+}
+
+// Records the received key ops of the wanted blocks, and imports the headers which can be imported
+func (sm *syncManager) handleKeyOps(sk *syncKeyOps) {
+	for _, bko := range sk.blocks {
+		req, ok := sm.inFlight[bko.Hash]
+		if !ok || req.peer != sk.peer || sm.wanted[bko.Height] != bko.Hash {
+			continue
+		}
+		delete(sm.inFlight, bko.Hash)
+		keyOps, err := p2pDecodeKeyOps(bko.KeyOps)
+		if err != nil {
+			log.Println("Invalid key ops of block", bko.Hash, "from", sk.peer.address, err)
+			p2pPeerScores.Penalize(sk.peer, p2pPenaltyInvalidBlock, "invalid key ops: "+err.Error())
+			sm.failed(bko.Hash, sk.peer)
+			continue
+		}
+		if _, ok := sm.keyOps[bko.Hash]; !ok {
+			sm.keyOps[bko.Hash] = &syncBlockKeyOps{
+				votes:  make(map[string]map[string]bool),
+				keyOps: make(map[string]map[string][]BlockKeyOp),
+				peers:  make(map[string][]*p2pConnection),
+			}
+		}
+		sm.keyOps[bko.Hash].add(sk.peer, p2pKeyOpsDigest(bko.Hash, bko.KeyOps), keyOps)
+	}
+	sm.importLightBlocks()
+}
+
+// Imports the agreed headers whose key ops have been agreed on, in height order. The key ops are
+// verified and applied first, since they can change which keys sign the following headers.
+func (sm *syncManager) importLightBlocks() {
+	imported := false
+	for {
+		h := dbGetBlockchainHeight() + 1
+		hash, ok := sm.wanted[h]
+		if !ok {
+			break
+		}
+		bko, ok := sm.keyOps[hash]
+		if !ok {
+			break
+		}
+		digest := bko.agreed()
+		if digest == "" {
+			break
+		}
+		dbb, err := sm.headers[hash].dbBlock()
+		if err == nil {
+			err = blockchainApplyKeyOps(bko.keyOps[digest], h, dbb.TimeAccepted)
+		}
+		if err == nil {
+			err = dbInsertBlock(dbb)
+		}
+		if err != nil {
+			log.Println("Cannot import header of block", hash, "at height", h, err)
+			delete(sm.keyOps, hash)
+			for _, peer := range bko.peers[digest] {
+				p2pPeerScores.Penalize(peer, p2pPenaltyInvalidBlock, "invalid key ops: "+err.Error())
+				sm.failed(hash, peer)
+			}
+			break
+		}
+		log.Println("Accepted header of block", hash, "at height", h)
+		sm.forget(h, hash)
+		imported = true
+	}
+	if imported {
+		sm.evaluate()
+	} else {
+		sm.schedule()
+	}
+}
+
+// Starts fetching a block on demand, unless it's already cached or being fetched
+func (sm *syncManager) handleFetchBlock(req *syncFetchRequest) {
+	if fileExists(lightCacheGetFilename(req.hash)) {
+		req.reply <- nil
+		return
+	}
+	f, ok := sm.fetches[req.hash]
+	if !ok {
+		f = &syncFetch{height: req.height, timeRequested: time.Now()}
+		sm.fetches[req.hash] = f
+	}
+	f.waiters = append(f.waiters, req.reply)
+	sm.schedule()
+}
+
+// Puts a block fetched on demand into the cache. The block's hash has already been checked
+// against the hash it was requested by, which comes from its signed header.
+func (sm *syncManager) handleFetchedBlock(rb *syncReceivedBlock) {
+	f, ok := sm.fetches[rb.hash]
+	if !ok {
+		log.Println("Ignoring block", rb.hash, "from", rb.peer.address, "which wasn't requested")
+		removeFile(rb.fileName)
+		return
+	}
+	delete(sm.fetches, rb.hash)
+	delete(sm.attempts, rb.hash)
+	delete(sm.tried, rb.hash)
+	err := lightCacheAdd(rb.fileName, rb.hash)
+	if err != nil {
+		log.Println("Cannot cache block", rb.hash, err)
+		removeFile(rb.fileName)
+	} else {
+		log.Println("Fetched block", rb.hash, "at height", f.height)
+	}
+	f.reply(err)
+}
+
+// Gives up on the blocks which couldn't be fetched in time
+func (sm *syncManager) expireFetches() {
+	for hash, f := range sm.fetches {
+		if time.Since(f.timeRequested) < lightFetchTimeout {
+			continue
+		}
+		f.reply(fmt.Errorf("timed out fetching block %s", hash))
+		delete(sm.fetches, hash)
+	}
+}
+
+// Returns the filename of the cached block with the given hash
+func lightCacheGetFilename(hash string) string {
+	return fmt.Sprintf("%s/%s/%s.db", cfg.DataDir, lightCacheSubdirectoryBaseName, hash)
+}
+
+// Moves a fetched block file into the cache, removing the least recently used blocks if there
+// are too many
+func lightCacheAdd(fileName string, hash string) error {
+	dir := fmt.Sprintf("%s/%s", cfg.DataDir, lightCacheSubdirectoryBaseName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	cacheFileName := lightCacheGetFilename(hash)
+	if err := os.Rename(fileName, cacheFileName); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.Chtimes(cacheFileName, now, now); err != nil {
+		log.Printf("lightCacheAdd os.Chtimes: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) <= lightCacheMaxBlocks {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, fi := range files[lightCacheMaxBlocks:] {
+		removeFile(filepath.Join(dir, fi.Name()))
+	}
+	return nil
+}
+
+// Opens the block at the given height. Light nodes fetch the block from a peer if it's not cached
+// (or stored, like the genesis block).
+func lightOpenBlockByHeight(height int) (*Block, error) {
+	if !cfg.Light || fileExists(blockchainGetFilename(height)) {
+		return OpenBlockByHeight(height)
+	}
+	dbb, err := dbGetBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	fileName := lightCacheGetFilename(dbb.Hash)
+	if !fileExists(fileName) {
+		reply := make(chan error, 1)
+		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlFetchBlock, payload: &syncFetchRequest{height: height, hash: dbb.Hash, reply: reply}}
+		if err = <-reply; err != nil {
+			return nil, err
+		}
+	}
+	// Recently used blocks are kept in the cache
+	now := time.Now()
+	if err = os.Chtimes(fileName, now, now); err != nil {
+		return nil, err
+	}
+	b, err := OpenBlockFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if b.Hash != dbb.Hash {
+		if err := b.Close(); err != nil {
+			log.Printf("lightOpenBlockByHeight b.Close: %v", err)
+		}
+		removeFile(fileName)
+		return nil, fmt.Errorf("Cached block hash doesn't match the recorded one: %s vs %s", b.Hash, dbb.Hash)
+	}
+	b.DbBlockchainBlock = dbb
+	return b, nil
+}
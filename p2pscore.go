@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// Every peer starts with a score which decreases with misbehaviour. When the score drops to the
+// threshold, the peer is banned; bans are stored in the main database and each subsequent ban of
+// the same peer lasts twice as long. Peers which authenticate with a chain key are identified by
+// the key, since several nodes can run on the same host. Other peers generate their own keys and
+// could come back with a new one, so they are identified by the host they connect from.
+const p2pInitialScore = 100
+const p2pBanThreshold = 0
+
+// Penalties subtracted from a peer's score
+const (
+	p2pPenaltyInvalidBlock = 50
+	p2pPenaltyBadJSON      = 50
+	p2pPenaltyWrongRoot    = 10
+	p2pPenaltySizeMismatch = 25
+	p2pPenaltyDesync       = 20
+	p2pPenaltyOversized    = 50
+)
+
+// The duration of the first ban, doubled for each following one up to the maximum
+const p2pBaseBanDuration = 15 * time.Minute
+const p2pMaxBanDuration = 30 * 24 * time.Hour
+
+// Scores of the peers which have misbehaved, slowly recovering with time
+type p2pPeerScoresType struct {
+	scores map[string]int
+	lock   WithMutex
+}
+
+var p2pPeerScores = p2pPeerScoresType{scores: make(map[string]int)}
+
+// Penalize decreases the score of the peer, and bans it and closes the connection if the
+// score drops to the threshold.
+func (ps *p2pPeerScoresType) Penalize(p2pc *p2pConnection, penalty int, reason string) {
+	// Peers are only penalized after they have authenticated
+	peer := p2pc.scoreIdentity()
+	score := 0
+	ps.lock.With(func() {
+		var ok bool
+		if score, ok = ps.scores[peer]; !ok {
+			score = p2pInitialScore
+		}
+		score -= penalty
+		if score <= p2pBanThreshold {
+			delete(ps.scores, peer)
+		} else {
+			ps.scores[peer] = score
+		}
+	})
+	log.Printf("Peer %v misbehaved (%s), score is now %d", p2pc.address, reason, score)
+	if score > p2pBanThreshold {
+		return
+	}
+	until := dbBanPeer(peer, reason)
+	log.Printf("Banning peer %v (%s) until %v", p2pc.address, peer, until)
+	if err := p2pc.conn.Close(); err != nil {
+		log.Printf("p2pc.conn.Close: %v", err)
+	}
+}
+
+// Recover moves the peers' scores back towards the initial score, so that occasional
+// faults do not add up to a ban.
+func (ps *p2pPeerScoresType) Recover(amount int) {
+	ps.lock.With(func() {
+		for peer, score := range ps.scores {
+			score += amount
+			if score >= p2pInitialScore {
+				delete(ps.scores, peer)
+			} else {
+				ps.scores[peer] = score
+			}
+		}
+	})
+}
+
+// Returns what the authenticated peer is scored and banned by: its key if it's a chain key, or
+// else the host it connects from
+func (p2pc *p2pConnection) scoreIdentity() string {
+	if p2pIsChainKey(p2pc.peerKeyHash) {
+		return p2pc.peerKeyHash
+	}
+	return p2pPeerHost(p2pc.conn.RemoteAddr().String())
+}
+
+// Returns true if the key is in the blockchain and not revoked
+func p2pIsChainKey(keyHash string) bool {
+	dbpk, err := dbGetPublicKey(keyHash)
+	return err == nil && dbpk.addBlockHeight >= 0 && !dbpk.isRevoked
+}
+
+// Returns the host part of the address
+func p2pPeerHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// Returns true if the peer authenticated with the given key from the given address is banned
+func p2pIsPeerBanned(keyHash string, address string) bool {
+	if p2pIsChainKey(keyHash) {
+		return dbIsPeerBanned(keyHash)
+	}
+	return dbIsPeerBanned(keyHash) || dbIsPeerBanned(p2pPeerHost(address))
+}
+
+// Returns true if the saved peer address is currently banned, by its pinned key or by its host.
+// All peers are checked again when they authenticate.
+func p2pIsBanned(address string) bool {
+	keyHash := dbGetPeerKeyHash(address)
+	if keyHash == "" {
+		return dbIsPeerBanned(p2pPeerHost(address))
+	}
+	return p2pIsPeerBanned(keyHash, address)
+}
+
+// Returns the duration of the n-th ban of a peer
+func p2pBanDuration(n int) time.Duration {
+	d := p2pBaseBanDuration
+	for i := 1; i < n && d < p2pMaxBanDuration; i++ {
+		d *= 2
+	}
+	if d > p2pMaxBanDuration {
+		d = p2pMaxBanDuration
+	}
+	return d
+}
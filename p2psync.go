@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// The sync manager first collects block headers from the peers and counts how many peers report
+// each block hash at each height. Only the blocks which a quorum of peers agrees on, and whose headers
+// form a chain extending our blockchain signed by known keys, are downloaded. The blocks are downloaded
+// from all the peers which advertise having them, requests which time out are retried on other peers,
+// and the blocks are imported in height order regardless of the order in which they arrive: blocks
+// which arrive before their previous block are kept as orphans. The sync manager lives in the p2p
+// coordinator goroutine and is not safe for concurrent use.
+//
+// Votes are counted by the key each peer authenticates with, which is a self-generated TLS key
+// unless -p2p-require-chain-key is set, so a quorum of more than one peer only resists a single node
+// posing as several peers with that flag. Only the headers and votes within syncMaxHeightsAhead of
+// our height are kept, each peer's key can hold at most syncMaxVotesPerPeer of them, and they are
+// dropped when the peer disconnects.
+//
+// In light mode, the key ops of the agreed blocks are requested instead of the blocks, and the
+// headers are imported once the key ops are verified; see p2plight.go.
+
+// The number of block requests which can be outstanding with a single peer
+const syncMaxInFlightPerPeer = 4
+
+// How long to wait for a requested block before asking another peer
+const syncRequestTimeout = 30 * time.Second
+
+// How long to wait for requested headers before asking the peer again
+const syncHeadersTimeout = 30 * time.Second
+
+// How many times a block is requested before giving up on it (until the next search for blocks)
+const syncMaxAttempts = 5
+
+// How far above our height block hashes and headers reported by the peers are kept
+const syncMaxHeightsAhead = 2 * p2pMaxHeaders
+
+// The number of block hashes and headers a single peer's key can have pending
+const syncMaxVotesPerPeer = 2 * syncMaxHeightsAhead
+
+// Block hashes reported by a peer, passed from the peer's goroutine to the sync manager
+type syncBlockHashes struct {
+	peer   *p2pConnection
+	hashes map[int]string
+}
+
+// Block headers sent by a peer, passed from the peer's goroutine to the sync manager
+type syncHeaders struct {
+	peer    *p2pConnection
+	headers []p2pBlockHeader
+}
+
+// A downloaded block waiting to be imported, passed from the peer's goroutine to the sync manager
+type syncReceivedBlock struct {
+	hash          string
+	hashSignature []byte
+	fileName      string // a temporary file owned by the sync manager
+	peer          *p2pConnection
+}
+
+// Key ops of blocks sent by a peer, passed from the peer's goroutine to the sync manager
+type syncKeyOps struct {
+	peer   *p2pConnection
+	blocks []p2pBlockKeyOps
+}
+
+// The key ops of a wanted block received from the peers, by their digest, in light mode
+type syncBlockKeyOps struct {
+	votes  map[string]map[string]bool         // keys of the peers which have sent each digest
+	keyOps map[string]map[string][]BlockKeyOp // the key ops with each digest
+	peers  map[string][]*p2pConnection        // the peers which have sent each digest
+}
+
+// A block request sent to a peer
+type syncRequest struct {
+	hash          string
+	height        int
+	peer          *p2pConnection
+	timeRequested time.Time
+}
+
+// The height of the last block agreed on by the sync quorum whose header has been verified, for
+// the health checks and metrics, which don't run in the coordinator goroutine
+var syncAgreedHeight = struct {
+	height int
+	lock   WithMutex
+}{}
+
+// Returns the height of the last block agreed on by the sync quorum
+func syncGetAgreedHeight() int {
+	var height int
+	syncAgreedHeight.lock.With(func() {
+		height = syncAgreedHeight.height
+	})
+	return height
+}
+
+type syncManager struct {
+	votes            map[int]map[string]map[string]bool // keys of the peers reporting each block hash at each height
+	voted            map[string]map[string]int          // the block hashes and heights reported by each peer's key
+	headers          map[string]*p2pBlockHeader         // block headers by hash
+	verified         map[string]bool                    // headers whose signatures have been verified
+	agreedHeight     int                                // the height of the last block agreed on by the quorum
+	headersRequested map[*p2pConnection]time.Time       // outstanding header requests
+	wanted           map[int]string                     // heights and hashes of blocks which should be downloaded
+	attempts         map[string]int                     // the number of times a block has been requested
+	tried            map[string]map[*p2pConnection]bool // peers which have failed to deliver a block
+	inFlight         map[string]*syncRequest            // outstanding requests, by block hash
+	keyOps           map[string]*syncBlockKeyOps        // received key ops of wanted blocks, in light mode
+	fetches          map[string]*syncFetch              // blocks fetched on demand, in light mode
+}
+
+func newSyncManager() *syncManager {
+	return &syncManager{
+		votes:            make(map[int]map[string]map[string]bool),
+		voted:            make(map[string]map[string]int),
+		headers:          make(map[string]*p2pBlockHeader),
+		verified:         make(map[string]bool),
+		headersRequested: make(map[*p2pConnection]time.Time),
+		wanted:           make(map[int]string),
+		attempts:         make(map[string]int),
+		tried:            make(map[string]map[*p2pConnection]bool),
+		inFlight:         make(map[string]*syncRequest),
+		keyOps:           make(map[string]*syncBlockKeyOps),
+		fetches:          make(map[string]*syncFetch),
+	}
+}
+
+// Records that the peer has the block with the given hash at the given height. Votes are counted
+// by the key the peer has authenticated with, so several connections from the same node count once.
+// Returns false if the height is outside the window we keep, or if the peer has too many votes pending.
+func (sm *syncManager) vote(peer *p2pConnection, height int, hash string, myHeight int) bool {
+	if height <= myHeight || height > myHeight+syncMaxHeightsAhead {
+		return false
+	}
+	voted := sm.voted[peer.peerKeyHash]
+	if voted == nil {
+		voted = make(map[string]int)
+		sm.voted[peer.peerKeyHash] = voted
+	}
+	if h, ok := voted[hash]; ok {
+		return h == height
+	}
+	if len(voted) >= syncMaxVotesPerPeer {
+		return false
+	}
+	voted[hash] = height
+	if sm.votes[height] == nil {
+		sm.votes[height] = make(map[string]map[string]bool)
+	}
+	if sm.votes[height][hash] == nil {
+		sm.votes[height][hash] = make(map[string]bool)
+	}
+	sm.votes[height][hash][peer.peerKeyHash] = true
+	return true
+}
+
+// Removes the votes of the peers' keys which are not in the given set, and the headers which
+// no remaining peer reports, unless their blocks are wanted.
+func (sm *syncManager) pruneVotes(keep map[string]bool) {
+	for keyHash := range sm.voted {
+		if keep[keyHash] {
+			continue
+		}
+		for hash, height := range sm.voted[keyHash] {
+			voters := sm.votes[height][hash]
+			delete(voters, keyHash)
+			if len(voters) > 0 {
+				continue
+			}
+			delete(sm.votes[height], hash)
+			if len(sm.votes[height]) == 0 {
+				delete(sm.votes, height)
+			}
+			if sm.wanted[height] != hash {
+				delete(sm.headers, hash)
+				delete(sm.verified, hash)
+			}
+		}
+		delete(sm.voted, keyHash)
+	}
+}
+
+// Counts the block hashes reported by a peer as votes, and asks for the headers which are missing
+func (sm *syncManager) handleBlockHashes(bh *syncBlockHashes) {
+	myHeight := dbGetBlockchainHeight()
+	for h, hash := range bh.hashes {
+		sm.vote(bh.peer, h, hash, myHeight)
+	}
+	sm.evaluate()
+	sm.requestHeaders()
+}
+
+// Counts the headers sent by a peer as votes and keeps the headers, then extends the chain of
+// agreed blocks and schedules their download.
+func (sm *syncManager) handleHeaders(sh *syncHeaders) {
+	delete(sm.headersRequested, sh.peer)
+	myHeight := dbGetBlockchainHeight()
+	for i := range sh.headers {
+		hdr := &sh.headers[i]
+		if !sm.vote(sh.peer, hdr.Height, hdr.Hash, myHeight) {
+			continue
+		}
+		if old, ok := sm.headers[hdr.Hash]; ok && (sm.verified[hdr.Hash] || *old == *hdr) {
+			continue
+		}
+		if err := hdr.verify(); err == nil {
+			sm.headers[hdr.Hash] = hdr
+			sm.verified[hdr.Hash] = true
+		} else if _, ok := sm.headers[hdr.Hash]; !ok {
+			// Might be signed by a key added in a block we don't have yet; verified later
+			sm.headers[hdr.Hash] = hdr
+		}
+	}
+	sm.evaluate()
+	sm.requestHeaders()
+}
+
+// Walks the heights after the end of our blockchain, and marks the blocks which a quorum of peers
+// agrees on and whose headers extend the chain as wanted.
+func (sm *syncManager) evaluate() {
+	myHeight := dbGetBlockchainHeight()
+	for h, hashes := range sm.votes {
+		if h <= myHeight {
+			for hash, voters := range hashes {
+				for keyHash := range voters {
+					delete(sm.voted[keyHash], hash)
+				}
+				delete(sm.headers, hash)
+				delete(sm.verified, hash)
+			}
+			delete(sm.votes, h)
+		}
+	}
+	prevHash := dbGetBlockHashByHeight(myHeight)
+	h := myHeight + 1
+	for ; ; h++ {
+		hash := sm.agreedHash(h, prevHash)
+		if hash == "" {
+			break
+		}
+		if wantedHash, ok := sm.wanted[h]; ok && wantedHash != hash {
+			log.Println("Block at height", h, "changed from", wantedHash, "to", hash)
+			sm.forget(h, wantedHash)
+		}
+		sm.wanted[h] = hash
+		prevHash = hash
+	}
+	sm.agreedHeight = h - 1
+	syncAgreedHeight.lock.With(func() {
+		syncAgreedHeight.height = sm.agreedHeight
+	})
+	sm.schedule()
+}
+
+// Returns the hash of the block at the given height which enough peers agree on, and whose
+// header is valid and extends the block with the given previous hash, or an empty string.
+func (sm *syncManager) agreedHash(height int, prevHash string) string {
+	for hash, voters := range sm.votes[height] {
+		if len(voters) < cfg.SyncQuorum {
+			continue
+		}
+		hdr, ok := sm.headers[hash]
+		if !ok || hdr.PreviousBlockHash != prevHash || hdr.Height != height {
+			continue
+		}
+		if !sm.verified[hash] {
+			if err := hdr.verify(); err != nil {
+				log.Println("Cannot verify header of block", hash, "at height", height, err)
+				continue
+			}
+			sm.verified[hash] = true
+		}
+		return hash
+	}
+	return ""
+}
+
+// Asks the peers which have more blocks than the quorum has agreed on for the next batch of headers
+func (sm *syncManager) requestHeaders() {
+	peers := []*p2pConnection{}
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc.helloReceived && p2pc.hasCapability(p2pCapHeaders) && p2pc.chainHeight > sm.agreedHeight {
+				peers = append(peers, p2pc)
+			}
+		}
+	})
+	myHeight := dbGetBlockchainHeight()
+	for _, p2pc := range peers {
+		if t, ok := sm.headersRequested[p2pc]; ok && time.Since(t) < syncHeadersTimeout {
+			continue
+		}
+		maxHeight := sm.agreedHeight + p2pMaxHeaders
+		if maxHeight > myHeight+syncMaxHeightsAhead {
+			maxHeight = myHeight + syncMaxHeightsAhead
+		}
+		if peerHeight := p2pc.getChainHeight(); maxHeight > peerHeight {
+			maxHeight = peerHeight
+		}
+		if maxHeight <= sm.agreedHeight {
+			continue
+		}
+		msg := p2pMsgGetHeadersStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pEphemeralID,
+				Root:  chainParams.GenesisBlockHash,
+				Msg:   p2pMsgGetHeaders,
+			},
+			MinBlockHeight: sm.agreedHeight + 1,
+			MaxBlockHeight: maxHeight,
+		}
+		select {
+		case p2pc.chanToPeer <- msg:
+			log.Printf("Requesting headers from %d to %d from %s", msg.MinBlockHeight, msg.MaxBlockHeight, p2pc.address)
+			sm.headersRequested[p2pc] = time.Now()
+		default:
+		}
+	}
+}
+
+// Returns the blockchain record of the block with the header. Headers don't carry the block
+// version, and the block is accepted now.
+func (hdr *p2pBlockHeader) dbBlock() (*DbBlockchainBlock, error) {
+	hashSignature, err := hex.DecodeString(hdr.HashSignature)
+	if err != nil {
+		return nil, err
+	}
+	previousBlockHashSignature, err := hex.DecodeString(hdr.PreviousBlockHashSignature)
+	if err != nil {
+		return nil, err
+	}
+	return &DbBlockchainBlock{
+		Height:                     hdr.Height,
+		Hash:                       hdr.Hash,
+		PreviousBlockHash:          hdr.PreviousBlockHash,
+		SignaturePublicKeyHash:     hdr.SignaturePublicKeyHash,
+		PreviousBlockHashSignature: previousBlockHashSignature,
+		HashSignature:              hashSignature,
+		TimeAccepted:               time.Now(),
+		Version:                    CurrentBlockVersion,
+	}, nil
+}
+
+// Verifies the header's signatures with the signing key, which must be valid at the header's height
+func (hdr *p2pBlockHeader) verify() error {
+	dbpk, err := dbGetPublicKey(hdr.SignaturePublicKeyHash)
+	if err != nil {
+		return fmt.Errorf("unknown signing key %s", hdr.SignaturePublicKeyHash)
+	}
+	if dbpk.addBlockHeight >= hdr.Height {
+		return fmt.Errorf("signing key %s is added later, at height %d", hdr.SignaturePublicKeyHash, dbpk.addBlockHeight)
+	}
+	if dbpk.revBlockHeight != -1 && dbpk.revBlockHeight < hdr.Height {
+		return fmt.Errorf("signing key %s is revoked at height %d", hdr.SignaturePublicKeyHash, dbpk.revBlockHeight)
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		return err
+	}
+	if err = cryptoVerifyHex(publicKey, hdr.Hash, hdr.HashSignature); err != nil {
+		return fmt.Errorf("invalid hash signature: %v", err)
+	}
+	if err = cryptoVerifyHex(publicKey, hdr.PreviousBlockHash, hdr.PreviousBlockHashSignature); err != nil {
+		return fmt.Errorf("invalid previous hash signature: %v", err)
+	}
+	return nil
+}
+
+// Assigns the wanted blocks which are not yet requested to the peers which have them,
+// preferring the least busy peers and the ones which haven't failed to deliver the block before.
+// In light mode, the key ops of the wanted blocks are requested instead, and only the blocks
+// fetched on demand are downloaded.
+func (sm *syncManager) schedule() {
+	peers := []*p2pConnection{}
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc.helloReceived && !p2pc.light {
+				peers = append(peers, p2pc)
+			}
+		}
+	})
+	load := make(map[*p2pConnection]int)
+	for _, req := range sm.inFlight {
+		load[req.peer]++
+	}
+	if cfg.Light {
+		sm.scheduleKeyOps(peers, load)
+		for hash, f := range sm.fetches {
+			if _, ok := sm.inFlight[hash]; !ok {
+				sm.requestBlock(hash, f.height, peers, load)
+			}
+		}
+		return
+	}
+	heights := make([]int, 0, len(sm.wanted))
+	for h := range sm.wanted {
+		heights = append(heights, h)
+	}
+	sort.Ints(heights)
+	for _, h := range heights {
+		hash := sm.wanted[h]
+		if _, ok := sm.inFlight[hash]; ok {
+			continue
+		}
+		if dbOrphanExists(hash) {
+			continue
+		}
+		sm.requestBlock(hash, h, peers, load)
+	}
+}
+
+// Returns the peer to request the block at the given height from, or nil if all the peers
+// which have it are busy
+func (sm *syncManager) choosePeer(hash string, height int, peers []*p2pConnection, load map[*p2pConnection]int) *p2pConnection {
+	var best *p2pConnection
+	for _, p2pc := range peers {
+		if p2pc.getChainHeight() < height || load[p2pc] >= syncMaxInFlightPerPeer {
+			continue
+		}
+		if best == nil || (sm.tried[hash][best] && !sm.tried[hash][p2pc]) ||
+			(sm.tried[hash][best] == sm.tried[hash][p2pc] && load[p2pc] < load[best]) {
+			best = p2pc
+		}
+	}
+	return best
+}
+
+// Requests the block from the best peer which has it
+func (sm *syncManager) requestBlock(hash string, height int, peers []*p2pConnection, load map[*p2pConnection]int) {
+	best := sm.choosePeer(hash, height, peers, load)
+	if best == nil {
+		return
+	}
+	msg := p2pMsgGetBlockStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetBlock,
+		},
+		Hash: hash,
+	}
+	// Marked before sending, so that the block isn't ignored if it arrives immediately
+	best.setBlockRequested(hash, true)
+	select {
+	case best.chanToPeer <- msg:
+	default:
+		// The peer's queue is full, don't block the coordinator
+		best.setBlockRequested(hash, false)
+		return
+	}
+	log.Println("Requesting block", hash, "at height", height, "from", best.address)
+	sm.inFlight[hash] = &syncRequest{hash: hash, height: height, peer: best, timeRequested: time.Now()}
+	sm.attempts[hash]++
+	load[best]++
+}
+
+// Accepts a downloaded block: imports it if it extends the blockchain, together with any orphan
+// blocks which extend it, or keeps it as an orphan if its previous block hasn't been imported yet.
+func (sm *syncManager) handleBlockReceived(rb *syncReceivedBlock) {
+	if req, ok := sm.inFlight[rb.hash]; !ok || req.peer != rb.peer {
+		// Blocks which haven't been requested from the peer might not be agreed on by the quorum
+		log.Println("Ignoring block", rb.hash, "from", rb.peer.address, "which wasn't requested from it")
+		removeFile(rb.fileName)
+		return
+	}
+	delete(sm.inFlight, rb.hash)
+	rb.peer.setBlockRequested(rb.hash, false)
+	if cfg.Light {
+		sm.handleFetchedBlock(rb)
+		return
+	}
+	if dbBlockHashExists(rb.hash) {
+		// Blocks arrive twice when a request has timed out and the block was requested again
+		log.Println("Already have block", rb.hash, "from", rb.peer.address)
+		removeFile(rb.fileName)
+		return
+	}
+	blk, err := OpenBlockFile(rb.fileName)
+	if err != nil {
+		log.Println("Error opening block file from", rb.peer.address, err)
+		removeFile(rb.fileName)
+		return
+	}
+	prevHash := blk.PreviousBlockHash
+	if err = blk.Close(); err != nil {
+		log.Printf("handleBlockReceived blk.Close: %v", err)
+	}
+	if !dbBlockHashExists(prevHash) {
+		// Only the blocks agreed on by the quorum are kept, so that peers can't fill the orphans
+		if !sm.isWanted(rb.hash) {
+			log.Println("Not keeping unwanted orphan block", rb.hash, "from", rb.peer.address)
+			removeFile(rb.fileName)
+			return
+		}
+		if err = orphanAdd(rb.fileName, rb.hash, rb.hashSignature, prevHash, rb.peer.peerKeyHash); err != nil {
+			log.Println("Cannot keep orphan block", rb.hash, err)
+			removeFile(rb.fileName)
+		}
+		return
+	}
+	blk, err = blockchainImportBlockFile(rb.fileName, rb.hashSignature)
+	removeFile(rb.fileName)
+	if err != nil {
+		log.Println("Cannot import block", rb.hash, "from", rb.peer.address, err)
+		// Only blocks which fail validation are the peer's fault; a block at the same height
+		// can have been imported in the meantime
+		if rerr, ok := err.(blockRejectedError); ok && rerr.reason != "existing_height" {
+			p2pPeerScores.Penalize(rb.peer, p2pPenaltyInvalidBlock, "invalid block: "+err.Error())
+		}
+		sm.failed(rb.hash, rb.peer)
+		return
+	}
+	log.Println("Accepted block", blk.Hash, "at height", blk.Height)
+	sm.forget(blk.Height, blk.Hash)
+	sm.connectOrphans(blk.Hash)
+	// The block might have added keys which sign the following headers
+	sm.evaluate()
+}
+
+// Returns true if the block with the given hash is one of the wanted blocks
+func (sm *syncManager) isWanted(hash string) bool {
+	for _, wantedHash := range sm.wanted {
+		if wantedHash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Imports the orphan blocks which extend the block with the given hash
+func (sm *syncManager) connectOrphans(hash string) {
+	for _, blk := range orphanConnect(hash) {
+		sm.forget(blk.Height, blk.Hash)
+	}
+}
+
+// Re-requests blocks which haven't arrived in time, or whose peers have disconnected
+func (sm *syncManager) checkTimeouts() {
+	connected := make(map[*p2pConnection]bool)
+	connectedKeys := make(map[string]bool)
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			connected[p2pc] = true
+			connectedKeys[p2pc.peerKeyHash] = true
+		}
+	})
+	sm.pruneVotes(connectedKeys)
+	for p2pc := range sm.headersRequested {
+		if !connected[p2pc] {
+			delete(sm.headersRequested, p2pc)
+		}
+	}
+	for hash, req := range sm.inFlight {
+		inTime := time.Since(req.timeRequested) < syncRequestTimeout || blockDownloadActive(hash, req.peer, syncRequestTimeout)
+		if inTime && connected[req.peer] {
+			continue
+		}
+		log.Println("Request for block", hash, "from", req.peer.address, "has timed out")
+		delete(sm.inFlight, hash)
+		req.peer.setBlockRequested(hash, false)
+		sm.failed(hash, req.peer)
+	}
+	sm.expireFetches()
+	if len(sm.wanted) > 0 || len(sm.fetches) > 0 {
+		sm.schedule()
+	}
+	sm.requestHeaders()
+}
+
+// Records that the peer has failed to deliver the block, and gives up on the block
+// (and all the blocks after it) if it has been requested too many times.
+func (sm *syncManager) failed(hash string, peer *p2pConnection) {
+	if sm.tried[hash] == nil {
+		sm.tried[hash] = make(map[*p2pConnection]bool)
+	}
+	sm.tried[hash][peer] = true
+	if sm.attempts[hash] < syncMaxAttempts {
+		return
+	}
+	log.Println("Giving up on block", hash, "after", sm.attempts[hash], "attempts")
+	if f, ok := sm.fetches[hash]; ok {
+		f.reply(fmt.Errorf("cannot fetch block %s from peers", hash))
+		delete(sm.fetches, hash)
+		delete(sm.attempts, hash)
+		delete(sm.tried, hash)
+		return
+	}
+	height := -1
+	for h, wantedHash := range sm.wanted {
+		if wantedHash == hash {
+			height = h
+		}
+	}
+	if height == -1 {
+		return
+	}
+	// The following blocks cannot be imported without it
+	for h, wantedHash := range sm.wanted {
+		if h >= height {
+			sm.forget(h, wantedHash)
+		}
+	}
+}
+
+// Forgets about a block which has been imported or given up on
+func (sm *syncManager) forget(height int, hash string) {
+	delete(sm.wanted, height)
+	delete(sm.attempts, hash)
+	delete(sm.tried, hash)
+	delete(sm.keyOps, hash)
+}
+
+// Removes a temporary file, logging errors
+func removeFile(fileName string) {
+	if err := os.Remove(fileName); err != nil {
+		log.Printf("remove: %v", err)
+	}
+}
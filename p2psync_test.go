@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Returns a block hash made up from the given string
+func testBlockHash(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns a chain of n headers signed with the given key, following the block with the given hash
+// at the given height. The label tells apart the chains from the same block.
+func testHeaders(t *testing.T, key *ecdsa.PrivateKey, keyHash string, prevHash string, prevHeight int, n int, label string) []p2pBlockHeader {
+	t.Helper()
+	headers := []p2pBlockHeader{}
+	for h := prevHeight + 1; h <= prevHeight+n; h++ {
+		hash := testBlockHash(fmt.Sprintf("%s %d", label, h))
+		hashSignature, err := cryptoSignHex(key, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevHashSignature, err := cryptoSignHex(key, prevHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, p2pBlockHeader{Height: h, Hash: hash, PreviousBlockHash: prevHash,
+			SignaturePublicKeyHash: keyHash, HashSignature: hashSignature, PreviousBlockHashSignature: prevHashSignature})
+		prevHash = hash
+	}
+	return headers
+}
+
+// Creates the system databases with a genesis block, and returns its hash
+func testSyncInit(t *testing.T, quorum int) string {
+	t.Helper()
+	testDbInit(t)
+	syncQuorum := cfg.SyncQuorum
+	cfg.SyncQuorum = quorum
+	t.Cleanup(func() {
+		cfg.SyncQuorum = syncQuorum
+	})
+	genesisHash := testBlockHash("genesis")
+	if err := dbInsertBlock(&DbBlockchainBlock{Height: 0, Hash: genesisHash, TimeAccepted: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	return genesisHash
+}
+
+func TestSyncManagerVote(t *testing.T) {
+	testSyncInit(t, 1)
+	sm := newSyncManager()
+	peer := &p2pConnection{peerKeyHash: "peer"}
+	sameKeyPeer := &p2pConnection{peerKeyHash: "peer"}
+	otherPeer := &p2pConnection{peerKeyHash: "other"}
+
+	tests := []struct {
+		name   string
+		peer   *p2pConnection
+		height int
+		hash   string
+		want   bool
+		voters int
+	}{
+		{"our height", peer, 0, "a", false, 0},
+		{"next height", peer, 1, "a", true, 1},
+		{"same vote again", peer, 1, "a", true, 1},
+		{"same key on another connection", sameKeyPeer, 1, "a", true, 1},
+		{"another key", otherPeer, 1, "a", true, 2},
+		{"same hash at another height", peer, 2, "a", false, 0},
+		{"last height in the window", peer, syncMaxHeightsAhead, "b", true, 1},
+		{"beyond the window", peer, syncMaxHeightsAhead + 1, "c", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sm.vote(tt.peer, tt.height, tt.hash, 0); got != tt.want {
+				t.Errorf("vote returned %v, want %v", got, tt.want)
+			}
+			if voters := len(sm.votes[tt.height][tt.hash]); voters != tt.voters {
+				t.Errorf("%d voters, want %d", voters, tt.voters)
+			}
+		})
+	}
+
+	t.Run("votes per peer", func(t *testing.T) {
+		for i := len(sm.voted[peer.peerKeyHash]); i < syncMaxVotesPerPeer; i++ {
+			if !sm.vote(peer, i%syncMaxHeightsAhead+1, fmt.Sprintf("fork %d", i), 0) {
+				t.Fatalf("vote %d refused", i)
+			}
+		}
+		if sm.vote(peer, 1, "one too many", 0) {
+			t.Error("accepted more than syncMaxVotesPerPeer votes from a peer")
+		}
+		if !sm.vote(otherPeer, 1, "one too many", 0) {
+			t.Error("refused a vote from another peer")
+		}
+	})
+}
+
+func TestSyncManagerHandleHeaders(t *testing.T) {
+	genesisHash := testSyncInit(t, 2)
+	key, keyHash := testKey(t, 0)
+	headers := testHeaders(t, key, keyHash, genesisHash, 0, 3, "main")
+	fork := testHeaders(t, key, keyHash, genesisHash, 0, 3, "fork")
+	farAhead := testHeaders(t, key, keyHash, testBlockHash("unknown"), syncMaxHeightsAhead-1, 2, "far")
+
+	sm := newSyncManager()
+	peer := &p2pConnection{peerKeyHash: "peer"}
+	sameKeyPeer := &p2pConnection{peerKeyHash: "peer"}
+	otherPeer := &p2pConnection{peerKeyHash: "other"}
+	forkPeer := &p2pConnection{peerKeyHash: "fork"}
+
+	tests := []struct {
+		name       string
+		peer       *p2pConnection
+		headers    []p2pBlockHeader
+		wantHeight int
+		numHeaders int
+	}{
+		{"one peer is not a quorum", peer, headers, 0, 3},
+		{"the same key again", sameKeyPeer, headers, 0, 3},
+		{"a fork from another peer", forkPeer, fork, 0, 6},
+		{"only the header within the window is kept", peer, farAhead, 0, 7},
+		{"a second peer agrees", otherPeer, headers, 3, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm.handleHeaders(&syncHeaders{peer: tt.peer, headers: tt.headers})
+			if sm.agreedHeight != tt.wantHeight {
+				t.Errorf("agreed height %d, want %d", sm.agreedHeight, tt.wantHeight)
+			}
+			if len(sm.headers) != tt.numHeaders {
+				t.Errorf("%d headers kept, want %d", len(sm.headers), tt.numHeaders)
+			}
+		})
+	}
+	for _, hdr := range headers {
+		if sm.wanted[hdr.Height] != hdr.Hash {
+			t.Errorf("block %s at height %d is not wanted", hdr.Hash, hdr.Height)
+		}
+	}
+
+	// None of the peers is connected: their votes and the headers which aren't wanted are dropped
+	sm.checkTimeouts()
+	if len(sm.votes) != 0 || len(sm.voted) != 0 {
+		t.Errorf("%d heights with votes and %d voters left after the peers disconnected", len(sm.votes), len(sm.voted))
+	}
+	if len(sm.headers) != len(headers) {
+		t.Errorf("%d headers left after the peers disconnected, want the %d wanted", len(sm.headers), len(headers))
+	}
+}
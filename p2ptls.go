@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// P2P connections are TLS sessions where both sides present a self-signed certificate made
+// from one of their keypairs. Certificates are not verified against any CA, instead the peer
+// is identified by the hash of its public key (in the same "type:hex" format as chain keys),
+// which can be pinned and checked against the pubkeys table.
+
+// How long the TLS handshake may take before the connection is dropped
+const p2pHandshakeTimeout = 30 * time.Second
+
+// The TLS configuration used for both incoming and outgoing p2p connections
+var p2pTLSConfig *tls.Config
+
+// The public key hash this node identifies with on the p2p network
+var p2pMyKeyHash string
+
+// Creates the node's TLS certificate from one of its private keys
+func p2pTLSInit() {
+	keypair, publicKeyHash, err := cryptoGetAPrivateKey()
+	if err != nil {
+		log.Fatalln("Cannot get a private key for p2p:", err)
+	}
+	cert, err := cryptoMakeSelfSignedCert(keypair, publicKeyHash)
+	if err != nil {
+		log.Fatalln("Cannot create p2p certificate:", err)
+	}
+	p2pMyKeyHash = publicKeyHash
+	p2pTLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// Peer certificates are self-signed, they are checked by p2pVerifyPeerCertificate
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p2pVerifyPeerCertificate,
+		MinVersion:            tls.VersionTLS12,
+	}
+	log.Println("P2P node key:", p2pMyKeyHash)
+}
+
+// Checks that the peer presented exactly one well-formed self-signed certificate with a P-256 key.
+// The peer's identity (its public key hash) is checked later, in p2pConnection.authenticate().
+func p2pVerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) != 1 {
+		return fmt.Errorf("expecting exactly one peer certificate, got %d", len(rawCerts))
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return fmt.Errorf("peer certificate is not self-signed: %v", err)
+	}
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pubKey.Curve != elliptic.P256() {
+		return errors.New("peer certificate doesn't have a P-256 ECDSA key")
+	}
+	return nil
+}
+
+// Returns the public key hash of the peer on the other side of a TLS connection
+func p2pPeerKeyHash(conn *tls.Conn) (string, error) {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) != 1 {
+		return "", errors.New("no peer certificate")
+	}
+	pubKey, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return "", errors.New("peer certificate doesn't have an ECDSA key")
+	}
+	return cryptoMustGetPublicKeyHash(pubKey), nil
+}
+
+// Dials a p2p peer and wraps the connection in TLS. The handshake is done in authenticate().
+func p2pDial(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, p2pHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(conn, p2pTLSConfig), nil
+}
+
+// Performs the TLS handshake and verifies the identity of the peer: its key must match the pinned
+// key (if any), neither the key nor (for peers without a chain key) the peer's host may be banned,
+// and if required by the configuration, it must be a valid chain key.
+func (p2pc *p2pConnection) authenticate(pinnedKeyHash string) error {
+	tlsConn, ok := p2pc.conn.(*tls.Conn)
+	if !ok {
+		return errors.New("not a TLS connection")
+	}
+	if err := tlsConn.SetDeadline(time.Now().Add(p2pHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	keyHash, err := p2pPeerKeyHash(tlsConn)
+	if err != nil {
+		return err
+	}
+	if keyHash == p2pMyKeyHash {
+		return fmt.Errorf("peer is using my own key %s", keyHash)
+	}
+	if pinnedKeyHash != "" && pinnedKeyHash != keyHash {
+		return fmt.Errorf("peer key %s doesn't match the pinned key %s", keyHash, pinnedKeyHash)
+	}
+	if p2pIsPeerBanned(keyHash, tlsConn.RemoteAddr().String()) {
+		return fmt.Errorf("peer key %s or its host is banned", keyHash)
+	}
+	if cfg.p2pRequireChainKey {
+		dbpk, err := dbGetPublicKey(keyHash)
+		if err != nil || dbpk.addBlockHeight < 0 {
+			return fmt.Errorf("peer key %s is not a chain key", keyHash)
+		}
+		if dbpk.isRevoked {
+			return fmt.Errorf("peer key %s is revoked", keyHash)
+		}
+	}
+	p2pc.peerKeyHash = keyHash
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Queries can be run in two ways. A per-block query is run separately on each block's database,
+// which is opened read-only. A unified query is run once over a range of blocks: the blocks are
+// attached (read-only) to a temporary workspace database, where each table name found in the
+// blocks becomes a view (or, for ranges of more blocks than SQLite can attach at once, a table
+// filled in batches) with the rows of that table from all the blocks and an additional _height
+// column, so aggregates and joins work across blocks. The _blocks table has the _height and
+// _hash of each block in the range. The workspace is kept in the query subdirectory of the data
+// directory and removed after the query. Filling the tables copies every row of the blocks for
+// each query, so unified queries are limited to queryMaxUnifiedBlocks blocks; the index database
+// has the same tables for the whole blockchain.
+//
+// Queries may only read data: SQLite itself refuses to prepare any statement of a query which
+// would write, attach other databases, change settings or control transactions, so the unified
+// queries, which run on a writable workspace database, can't change it either.
+
+// SQLITE_RECURSIVE, which the driver doesn't export
+const querySqliteRecursive = 33
+
+// The number of databases SQLite can attach at once (SQLITE_MAX_ATTACHED)
+const queryMaxAttached = 10
+
+const querySubdirectoryBaseName = "query"
+
+// The number of blocks a unified query can span
+const queryMaxUnifiedBlocks = 1000
+
+// Returned by a row callback to stop the query without an error
+var errQueryStop = errors.New("query stopped")
+
+// Returned when a query does anything other than reading data
+var errQueryNotReadOnly = errors.New("only queries which read data are allowed")
+
+// Makes SQLite refuse to prepare statements on the connection which do anything other than
+// reading data. The statements which prepare the connection for a query must run before this.
+func queryRestrictConn(conn *sql.Conn) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		sc, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected database connection %T", driverConn)
+		}
+		sc.RegisterAuthorizer(func(action int, arg1 string, arg2 string, arg3 string) int {
+			switch action {
+			case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, querySqliteRecursive:
+				return sqlite3.SQLITE_OK
+			}
+			return sqlite3.SQLITE_DENY
+		})
+		return nil
+	})
+}
+
+// Runs the query on a connection restricted by queryRestrictConn. Statements which SQLite refuses
+// to prepare return errQueryNotReadOnly.
+func queryRestricted(ctx context.Context, conn *sql.Conn, q string, args []interface{}) (*sql.Rows, error) {
+	if err := queryRestrictConn(conn); err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, q, args...)
+	if serr, ok := err.(sqlite3.Error); ok && serr.Code == sqlite3.ErrAuth {
+		return nil, errQueryNotReadOnly
+	}
+	return rows, err
+}
+
+// Runs the query with the given arguments on each block in the range of heights, newest first
+// (or oldest first if ascending), and calls the callback with the column names and each result
+// row. Blocks on which the query fails (usually because they don't have the queried table) are
+// counted and skipped. The query stops when the context is done or the callback returns an error;
+// errQueryStop stops it without an error.
+// Returns the number of blocks queried and the number of blocks on which the query failed.
+func blockchainQuery(ctx context.Context, q string, args []interface{}, minHeight int, maxHeight int, ascending bool,
+	callback func(height int, hash string, cols []string, row map[string]interface{}) error) (int, int, error) {
+	blocks, errCount := 0, 0
+	h, step := maxHeight, -1
+	if ascending {
+		h, step = minHeight, 1
+	}
+	for ; h >= minHeight && h <= maxHeight; h += step {
+		if err := ctx.Err(); err != nil {
+			return blocks, errCount, err
+		}
+		hash := dbGetBlockHashByHeight(h)
+		if hash == "" {
+			continue
+		}
+		err := blockQuery(ctx, blockchainGetFilename(h), q, args, func(cols []string, row map[string]interface{}) error {
+			return callback(h, hash, cols, row)
+		})
+		blocks++
+		if err == errQueryStop {
+			return blocks, errCount, nil
+		}
+		if err == errQueryNotReadOnly {
+			return blocks, errCount, err
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return blocks, errCount, ctxErr
+			}
+			if cerr, ok := err.(queryCallbackError); ok {
+				return blocks, errCount, cerr.err
+			}
+			errCount++
+		}
+	}
+	return blocks, errCount, nil
+}
+
+// Wraps errors returned by the row callback, to tell them apart from query errors
+type queryCallbackError struct {
+	err error
+}
+
+func (e queryCallbackError) Error() string {
+	return e.err.Error()
+}
+
+// Runs the query on a single block file and calls the callback with the column names and each result row
+func blockQuery(ctx context.Context, fileName string, q string, args []interface{}, callback func(cols []string, row map[string]interface{}) error) error {
+	db, err := dbOpen(fileName, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := queryRestricted(ctx, conn, q, args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		row, err := dbScanRowToMap(rows, cols)
+		if err != nil {
+			return err
+		}
+		if err = callback(cols, row); err != nil {
+			if err == errQueryStop {
+				return err
+			}
+			return queryCallbackError{err}
+		}
+	}
+	return rows.Err()
+}
+
+// A table found in the blocks of a unified query
+type queryTable struct {
+	name    string
+	columns []string                // all the columns found in any block, in the order found
+	blocks  map[int]map[string]bool // the columns of the table in each block which has it
+}
+
+// Returns the tables in the blocks in the range of heights, with their columns
+func queryCollectTables(ctx context.Context, heights []int) ([]*queryTable, error) {
+	tables := make(map[string]*queryTable)
+	for _, h := range heights {
+		db, err := dbOpen(blockchainGetFilename(h), true)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := db.QueryContext(ctx, "SELECT m.name, p.name FROM sqlite_master m, pragma_table_info(m.name) p WHERE m.type='table' AND m.name NOT LIKE 'sqlite_%' AND m.name != '_blocks' ORDER BY m.name, p.cid")
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("block %d: %v", h, err)
+		}
+		for rows.Next() {
+			var tableName, columnName string
+			if err = rows.Scan(&tableName, &columnName); err != nil {
+				break
+			}
+			t, ok := tables[tableName]
+			if !ok {
+				t = &queryTable{name: tableName, blocks: make(map[int]map[string]bool)}
+				tables[tableName] = t
+			}
+			if t.blocks[h] == nil {
+				t.blocks[h] = make(map[string]bool)
+			}
+			t.blocks[h][columnName] = true
+			if !inStrings(columnName, t.columns) {
+				t.columns = append(t.columns, columnName)
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		db.Close()
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %v", h, err)
+		}
+	}
+	result := make([]*queryTable, 0, len(tables))
+	for _, t := range tables {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result, nil
+}
+
+// Returns the SELECT statement with the rows of the table from the blocks in the batch, which are
+// attached under the names returned by querySchemaName. Missing columns are NULL.
+func (t *queryTable) batchSelect(batch []int) string {
+	selects := []string{}
+	for i, h := range batch {
+		blockColumns, ok := t.blocks[h]
+		if !ok {
+			continue
+		}
+		fields := []string{fmt.Sprintf("%d AS _height", h)}
+		for _, c := range t.columns {
+			if blockColumns[c] {
+				fields = append(fields, dbQuoteIdentifier(c))
+			} else {
+				fields = append(fields, "NULL AS "+dbQuoteIdentifier(c))
+			}
+		}
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM %s.%s", strings.Join(fields, ", "), querySchemaName(i), dbQuoteIdentifier(t.name)))
+	}
+	return strings.Join(selects, " UNION ALL ")
+}
+
+// Returns the name the i-th block of a batch is attached under
+func querySchemaName(i int) string {
+	return fmt.Sprintf("_block%d", i)
+}
+
+// Returns the SQLite URI which opens the block file read-only
+func queryBlockURI(fileName string) string {
+	u := url.URL{Scheme: "file", Path: fileName, RawQuery: "mode=ro"}
+	return u.String()
+}
+
+// Runs the query with the given arguments once over all the blocks in the range of heights, in a
+// temporary workspace database, and calls the callback with the column names and each result row.
+// The callback can return errQueryStop to stop the query without an error. Returns the number of
+// blocks queried.
+func blockchainQueryUnified(ctx context.Context, q string, args []interface{}, minHeight int, maxHeight int,
+	callback func(cols []string, row map[string]interface{}) error) (int, error) {
+	hashes := dbGetHeightHashes(minHeight, maxHeight)
+	heights := make([]int, 0, len(hashes))
+	for h := range hashes {
+		heights = append(heights, h)
+	}
+	sort.Ints(heights)
+	if len(heights) > queryMaxUnifiedBlocks {
+		return 0, fmt.Errorf("a unified query can span at most %d blocks, not %d; query a smaller range or the index", queryMaxUnifiedBlocks, len(heights))
+	}
+	tables, err := queryCollectTables(ctx, heights)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := queryWorkspaceTempFile()
+	if err != nil {
+		return 0, err
+	}
+	workspaceFileName := f.Name()
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := os.Remove(workspaceFileName); err != nil {
+			log.Printf("blockchainQueryUnified os.Remove: %v", err)
+		}
+	}()
+	db, err := dbOpen(workspaceFileName, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	// Attached databases and temporary views belong to a single connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "CREATE TABLE _blocks (_height INTEGER PRIMARY KEY, _hash VARCHAR NOT NULL)"); err != nil {
+		return 0, err
+	}
+	for _, h := range heights {
+		if _, err = conn.ExecContext(ctx, "INSERT INTO _blocks (_height, _hash) VALUES (?, ?)", h, hashes[h]); err != nil {
+			return 0, err
+		}
+	}
+	batched := len(heights) > queryMaxAttached
+	if batched {
+		for _, t := range tables {
+			columns := []string{"_height INTEGER"}
+			for _, c := range t.columns {
+				columns = append(columns, dbQuoteIdentifier(c))
+			}
+			if _, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", dbQuoteIdentifier(t.name), strings.Join(columns, ", "))); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for start := 0; start < len(heights); start += queryMaxAttached {
+		end := start + queryMaxAttached
+		if end > len(heights) {
+			end = len(heights)
+		}
+		batch := heights[start:end]
+		if err = queryAttachBatch(ctx, conn, batch); err != nil {
+			return 0, err
+		}
+		for _, t := range tables {
+			sel := t.batchSelect(batch)
+			if sel == "" {
+				continue
+			}
+			if batched {
+				_, err = conn.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s %s", dbQuoteIdentifier(t.name), sel))
+			} else {
+				_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE TEMP VIEW %s AS %s", dbQuoteIdentifier(t.name), sel))
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		if batched {
+			if err = queryDetachBatch(ctx, conn, batch); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	rows, err := queryRestricted(ctx, conn, q, args)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		row, err := dbScanRowToMap(rows, cols)
+		if err != nil {
+			return len(heights), err
+		}
+		if err = callback(cols, row); err != nil {
+			if err == errQueryStop {
+				return len(heights), nil
+			}
+			return len(heights), err
+		}
+	}
+	return len(heights), rows.Err()
+}
+
+// Creates a temporary file for the workspace database of a unified query in the data directory
+func queryWorkspaceTempFile() (*os.File, error) {
+	dir := fmt.Sprintf("%s/%s", cfg.DataDir, querySubdirectoryBaseName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "workspace-*.db")
+}
+
+// Attaches the blocks at the given heights to the workspace database
+func queryAttachBatch(ctx context.Context, conn *sql.Conn, batch []int) error {
+	for i, h := range batch {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf("ATTACH DATABASE ? AS %s", querySchemaName(i)), queryBlockURI(blockchainGetFilename(h)))
+		if err != nil {
+			return fmt.Errorf("block %d: %v", h, err)
+		}
+	}
+	return nil
+}
+
+// Detaches the blocks attached by queryAttachBatch
+func queryDetachBatch(ctx context.Context, conn *sql.Conn, batch []int) error {
+	for i := range batch {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("DETACH DATABASE %s", querySchemaName(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
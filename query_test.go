@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryRestricted(t *testing.T) {
+	ctx := context.Background()
+	// A writable database, like the workspace of the unified queries
+	db, err := dbOpen(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE t (a INTEGER, b VARCHAR); INSERT INTO t VALUES (1, 'one'), (2, 'two')"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		q       string
+		args    []interface{}
+		allowed bool
+	}{
+		{"select", "SELECT a, b FROM t", nil, true},
+		{"select with arguments", "SELECT b FROM t WHERE a = ?", []interface{}{2}, true},
+		{"aggregate function", "SELECT COUNT(*), MAX(a), UPPER(b) FROM t", nil, true},
+		{"recursive cte", "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 5) SELECT SUM(i) FROM n", nil, true},
+		{"insert", "INSERT INTO t VALUES (3, 'three')", nil, false},
+		{"update", "UPDATE t SET b = 'changed'", nil, false},
+		{"delete", "DELETE FROM t", nil, false},
+		{"drop table", "DROP TABLE t", nil, false},
+		{"create temp table", "CREATE TEMP TABLE x (a)", nil, false},
+		{"create temp view", "CREATE TEMP VIEW v AS SELECT * FROM t", nil, false},
+		{"attach", "ATTACH DATABASE ':memory:' AS other", nil, false},
+		{"pragma", "PRAGMA writable_schema = 1", nil, false},
+		{"transaction", "BEGIN", nil, false},
+		{"select then drop", "SELECT 1; DROP TABLE t", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			rows, err := queryRestricted(ctx, conn, tt.q, tt.args)
+			if err == nil {
+				for rows.Next() {
+				}
+				err = rows.Err()
+				rows.Close()
+			}
+			if tt.allowed && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.allowed && err != errQueryNotReadOnly {
+				t.Errorf("got error %v, want %v", err, errQueryNotReadOnly)
+			}
+		})
+	}
+
+	var count int
+	var sum int
+	if err = db.QueryRow("SELECT COUNT(*), SUM(a) FROM t WHERE b != 'changed'").Scan(&count, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || sum != 3 {
+		t.Errorf("the table has changed: %d rows with a sum of %d", count, sum)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Query results printed by the query command can be formatted as JSON lines (one object per row),
+// a JSON array, CSV (with a header row) or an aligned text table. In CSV and table output, BLOB
+// values are base64-encoded, as they are in JSON. Per-block queries can return different columns
+// from different blocks: the table gets the columns of all the rows, while CSV output fails when
+// the columns change, since its header has already been written.
+
+// Output formats of the query command
+const (
+	queryFormatJSONLines = "jsonl"
+	queryFormatJSON      = "json"
+	queryFormatCSV       = "csv"
+	queryFormatTable     = "table"
+)
+
+var queryFormats = []string{queryFormatJSONLines, queryFormatJSON, queryFormatCSV, queryFormatTable}
+
+// Formats query result rows
+type queryOutput struct {
+	format  string
+	w       io.Writer
+	csv     *csv.Writer
+	columns []string   // the columns of the first row (for tables, of all the rows)
+	rows    [][]string // table rows, which are printed when all the widths are known
+	count   int
+}
+
+func newQueryOutput(format string, w io.Writer) (*queryOutput, error) {
+	if !inStrings(format, queryFormats) {
+		return nil, fmt.Errorf("unknown output format %s (expecting one of: %s)", format, strings.Join(queryFormats, ", "))
+	}
+	o := queryOutput{format: format, w: w}
+	if format == queryFormatCSV {
+		o.csv = csv.NewWriter(w)
+	}
+	return &o, nil
+}
+
+// Writes a result row with the given columns
+func (o *queryOutput) Write(cols []string, row map[string]interface{}) error {
+	if o.count == 0 {
+		o.columns = append([]string{}, cols...)
+	} else if o.format == queryFormatCSV && !querySameColumns(o.columns, cols) {
+		return fmt.Errorf("the columns have changed from %s to %s, which CSV output can't show; use the %s format",
+			strings.Join(o.columns, ", "), strings.Join(cols, ", "), queryFormatJSONLines)
+	} else if o.format == queryFormatTable {
+		for _, c := range cols {
+			if !inStrings(c, o.columns) {
+				o.columns = append(o.columns, c)
+			}
+		}
+	}
+	o.count++
+	switch o.format {
+	case queryFormatJSONLines, queryFormatJSON:
+		buf, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		prefix := ""
+		if o.format == queryFormatJSON {
+			prefix = ",\n"
+			if o.count == 1 {
+				prefix = "[\n"
+			}
+		}
+		_, err = fmt.Fprintf(o.w, "%s%s", prefix, buf)
+		if err == nil && o.format == queryFormatJSONLines {
+			_, err = fmt.Fprintln(o.w)
+		}
+		return err
+	case queryFormatCSV:
+		if o.count == 1 {
+			if err := o.csv.Write(o.columns); err != nil {
+				return err
+			}
+		}
+		record := make([]string, len(o.columns))
+		for i, c := range o.columns {
+			if v, ok := row[c]; ok && v != nil {
+				record[i] = queryFormatValue(v)
+			}
+		}
+		return o.csv.Write(record)
+	case queryFormatTable:
+		record := make([]string, len(o.columns))
+		for i, c := range o.columns {
+			v, ok := row[c]
+			if !ok || v == nil {
+				record[i] = "NULL"
+			} else {
+				// Keep each row on a single line
+				record[i] = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", " ").Replace(queryFormatValue(v))
+			}
+		}
+		o.rows = append(o.rows, record)
+	}
+	return nil
+}
+
+// Finishes the output
+func (o *queryOutput) Close() error {
+	switch o.format {
+	case queryFormatJSON:
+		if o.count == 0 {
+			_, err := fmt.Fprintln(o.w, "[]")
+			return err
+		}
+		_, err := fmt.Fprintln(o.w, "\n]")
+		return err
+	case queryFormatCSV:
+		o.csv.Flush()
+		return o.csv.Error()
+	case queryFormatTable:
+		return o.writeTable()
+	}
+	return nil
+}
+
+// Returns true if both lists have the same columns, in any order
+func querySameColumns(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, c := range b {
+		if !inStrings(c, a) {
+			return false
+		}
+	}
+	return true
+}
+
+// Prints the table rows with aligned columns, and the number of rows
+func (o *queryOutput) writeTable() error {
+	// Rows written before columns were added don't have them
+	for i, record := range o.rows {
+		for len(record) < len(o.columns) {
+			record = append(record, "NULL")
+		}
+		o.rows[i] = record
+	}
+	widths := make([]int, len(o.columns))
+	for i, c := range o.columns {
+		widths[i] = len([]rune(c))
+	}
+	for _, record := range o.rows {
+		for i, v := range record {
+			if l := len([]rune(v)); l > widths[i] {
+				widths[i] = l
+			}
+		}
+	}
+	line := func(record []string) error {
+		fields := make([]string, len(record))
+		for i, v := range record {
+			fields[i] = v + strings.Repeat(" ", widths[i]-len([]rune(v)))
+		}
+		_, err := fmt.Fprintln(o.w, strings.TrimRight(strings.Join(fields, " | "), " "))
+		return err
+	}
+	if len(o.columns) != 0 {
+		if err := line(o.columns); err != nil {
+			return err
+		}
+		separator := make([]string, len(widths))
+		for i, w := range widths {
+			separator[i] = strings.Repeat("-", w)
+		}
+		if _, err := fmt.Fprintln(o.w, strings.Join(separator, "-+-")); err != nil {
+			return err
+		}
+	}
+	for _, record := range o.rows {
+		if err := line(record); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(o.w, "(%d rows)\n", len(o.rows))
+	return err
+}
+
+// Returns the text representation of a value for CSV and table output
+func queryFormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -116,6 +118,20 @@ func (m StrIfMap) GetString(key string) (string, error) {
 	return val, nil
 }
 
+// GetBool returns a bool from this map.
+func (m StrIfMap) GetBool(key string) (bool, error) {
+	var ok bool
+	var ii interface{}
+	if ii, ok = m[key]; !ok {
+		return false, fmt.Errorf("No '%s' key in map", key)
+	}
+	var val bool
+	if val, ok = ii.(bool); !ok {
+		return false, fmt.Errorf("The '%s' key in map is not a bool", key)
+	}
+	return val, nil
+}
+
 // GetInt64 returns an Int64 from this map.
 func (m StrIfMap) GetInt64(key string) (int64, error) {
 	var ok bool
@@ -192,6 +208,20 @@ func (m StrIfMap) GetStringList(key string) ([]string, error) {
 	return result, nil
 }
 
+// Decode decodes the value of the given key into v, which should be a pointer to a type
+// which can be unmarshalled from JSON.
+func (m StrIfMap) Decode(key string, v interface{}) error {
+	ii, ok := m[key]
+	if !ok {
+		return fmt.Errorf("No '%s' key in map", key)
+	}
+	b, err := json.Marshal(ii)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
 // StringSetWithExpiry is a set of strings whose entries disappear after a given time.
 type StringSetWithExpiry struct {
 	data map[string]time.Time
@@ -408,3 +438,56 @@ func countStartZeroBits(b []byte) int {
 	}
 	return nBits
 }
+
+// errLineTooLong is returned by readLineLimited when a line is longer than allowed
+var errLineTooLong = errors.New("line too long")
+
+// Reads a single line terminated by '\n', without buffering more than maxLen bytes of it
+func readLineLimited(r *bufio.Reader, maxLen int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > maxLen {
+			return nil, errLineTooLong
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
+
+// RateLimiter is a token bucket allowing a number of events per second, with bursts.
+// It is not safe for concurrent use.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a new RateLimiter which starts with a full bucket
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until an event is allowed
+func (rl *RateLimiter) Wait() {
+	if rl.rate <= 0 {
+		return
+	}
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	if rl.tokens < 1 {
+		wait := time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+		time.Sleep(wait)
+		rl.tokens = 1
+		rl.last = time.Now()
+	}
+	rl.tokens--
+}
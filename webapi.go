@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The JSON API of the HTTP server, for block explorers and other tools. Lists are paged with the
+// limit and offset query parameters, and errors are returned as {"error": "..."}.
+
+// The default and the maximum number of items in a page
+const webAPIDefaultLimit = 100
+const webAPIMaxLimit = 1000
+
+// The longest time a query may run, and the most rows it may return
+const webAPIQueryTimeout = 30 * time.Second
+const webAPIQueryMaxRows = 10000
+
+// A page of a list
+type webAPIPage struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+// A block's metadata, and in /api/block its tables
+type webAPIBlock struct {
+	Height                     int              `json:"height"`
+	Hash                       string           `json:"hash"`
+	HashSignature              string           `json:"hash_signature"`
+	PreviousBlockHash          string           `json:"prev_hash"`
+	PreviousBlockHashSignature string           `json:"prev_hash_signature"`
+	SignaturePublicKeyHash     string           `json:"sigkey_hash"`
+	TimeAccepted               time.Time        `json:"time_accepted"`
+	Version                    int              `json:"version"`
+	Tables                     []BlockTableInfo `json:"tables,omitempty"`
+}
+
+// A public key from the pubkeys table
+type webAPIKey struct {
+	PublicKeyHash      string            `json:"pubkey_hash"`
+	PublicKey          string            `json:"pubkey"`
+	State              string            `json:"state"`
+	TimeAdded          time.Time         `json:"time_added"`
+	BlockHeightAdded   int               `json:"block_height_added"`
+	Revoked            bool              `json:"revoked"`
+	TimeRevoked        *time.Time        `json:"time_revoked,omitempty"`
+	BlockHeightRevoked int               `json:"block_height_revoked"` // -1 if not revoked
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// A connected peer
+type webAPIPeer struct {
+	Address         string    `json:"address"`
+	PeerID          string    `json:"peer_id"`
+	KeyHash         string    `json:"key_hash"`
+	Outbound        bool      `json:"outbound"`
+	ListenPort      int       `json:"listen_port"`
+	Connectable     bool      `json:"connectable"`
+	Light           bool      `json:"light"`
+	ChainHeight     int       `json:"chain_height"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Capabilities    []string  `json:"capabilities"`
+	TimeConnected   time.Time `json:"time_connected"`
+}
+
+// The node's status
+type webAPIStatus struct {
+	Version          string `json:"version"`
+	ProtocolVersion  int    `json:"protocol_version"`
+	EphemeralID      string `json:"ephemeral_id"`
+	GenesisBlockHash string `json:"genesis_hash"`
+	Height           int    `json:"height"`
+	Hash             string `json:"hash"`
+	Peers            int    `json:"peers"`
+	InboundPeers     int    `json:"inbound_peers"`
+	Light            bool   `json:"light"`
+}
+
+// A result row of a query, with the block it comes from
+type webAPIQueryRow struct {
+	Height int                    `json:"height"`
+	Hash   string                 `json:"hash"`
+	Row    map[string]interface{} `json:"row"`
+}
+
+// A result row of a unified query, which is run once over all the blocks
+type webAPIQueryUnifiedRow struct {
+	Row map[string]interface{} `json:"row"`
+}
+
+// The summary of a query, sent after its result rows
+type webAPIQueryEnd struct {
+	Rows      int    `json:"rows"`
+	Blocks    int    `json:"blocks"`
+	Errors    int    `json:"errors"`    // blocks on which the query has failed
+	Truncated bool   `json:"truncated"` // the row limit has been reached
+	Error     string `json:"error,omitempty"`
+}
+
+// Registers the API handlers, which are all protected endpoints (see httpauth.go)
+func webAPIRegister(r *mux.Router) {
+	r.HandleFunc("/api/status", httpAuthProtect(webAPIStatusHandler))
+	r.HandleFunc("/api/blocks", httpAuthProtect(webAPIBlocksHandler))
+	r.HandleFunc("/api/block/{id}", httpAuthProtect(webAPIBlockHandler))
+	r.HandleFunc("/api/keys", httpAuthProtect(webAPIKeysHandler))
+	r.HandleFunc("/api/key/{hash}", httpAuthProtect(webAPIKeyHandler))
+	r.HandleFunc("/api/peers", httpAuthProtect(webAPIPeersHandler))
+	r.HandleFunc("/api/query", httpAuthProtect(webAPIQueryHandler))
+	r.HandleFunc("/api/events", httpAuthProtect(webAPIEventsHandler))
+}
+
+// Writes the value as a JSON response
+func webAPIWrite(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(jsonifyWhateverToBytes(v)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Writes the value as a JSON response with the given HTTP status
+func webAPIWriteStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(jsonifyWhateverToBytes(v)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Writes an error response
+func webAPIError(w http.ResponseWriter, status int, message string) {
+	webAPIWriteStatus(w, status, map[string]string{"error": message})
+}
+
+// Returns the value of the integer query parameter, or the default value if it isn't given
+func webAPIIntParam(r *http.Request, name string, defaultValue int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return v, nil
+}
+
+// Returns the boolean query parameter, or false if it's not given
+func webAPIBoolParam(r *http.Request, name string) (bool, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", name, s)
+	}
+	return v, nil
+}
+
+// Returns the limit and offset query parameters
+func webAPIPagination(r *http.Request) (int, int, error) {
+	limit, err := webAPIIntParam(r, "limit", webAPIDefaultLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit < 0 || limit > webAPIMaxLimit {
+		return 0, 0, fmt.Errorf("limit must be between 0 and %d", webAPIMaxLimit)
+	}
+	offset, err := webAPIIntParam(r, "offset", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("offset must not be negative")
+	}
+	return limit, offset, nil
+}
+
+// Converts a blockchain record to its API form
+func webAPINewBlock(dbb *DbBlockchainBlock) webAPIBlock {
+	return webAPIBlock{
+		Height:                     dbb.Height,
+		Hash:                       dbb.Hash,
+		HashSignature:              hex.EncodeToString(dbb.HashSignature),
+		PreviousBlockHash:          dbb.PreviousBlockHash,
+		PreviousBlockHashSignature: hex.EncodeToString(dbb.PreviousBlockHashSignature),
+		SignaturePublicKeyHash:     dbb.SignaturePublicKeyHash,
+		TimeAccepted:               dbb.TimeAccepted,
+		Version:                    dbb.Version,
+	}
+}
+
+// Converts a public key record to its API form
+func webAPINewKey(dbpk *DbPubKey) webAPIKey {
+	k := webAPIKey{
+		PublicKeyHash:      dbpk.publicKeyHash,
+		PublicKey:          hex.EncodeToString(dbpk.publicKeyBytes),
+		State:              dbpk.state,
+		TimeAdded:          dbpk.timeAdded,
+		BlockHeightAdded:   dbpk.addBlockHeight,
+		Revoked:            dbpk.isRevoked,
+		BlockHeightRevoked: dbpk.revBlockHeight,
+		Metadata:           dbpk.metadata,
+	}
+	if dbpk.isRevoked {
+		k.TimeRevoked = &dbpk.timeRevoked
+	}
+	return k
+}
+
+// /api/status: the node's version, blockchain height and peers
+func webAPIStatusHandler(w http.ResponseWriter, r *http.Request) {
+	height := dbGetBlockchainHeight()
+	peers := 0
+	p2pPeers.lock.With(func() {
+		peers = len(p2pPeers.peers)
+	})
+	webAPIWrite(w, webAPIStatus{
+		Version:          p2pClientVersionString,
+		ProtocolVersion:  p2pProtocolVersion,
+		EphemeralID:      fmt.Sprintf("%x", p2pEphemeralID),
+		GenesisBlockHash: chainParams.GenesisBlockHash,
+		Height:           height,
+		Hash:             dbGetBlockHashByHeight(height),
+		Peers:            peers,
+		InboundPeers:     p2pPeers.CountInbound(),
+		Light:            cfg.Light,
+	})
+}
+
+// /api/blocks?from=&to=: the metadata of the blocks in the range of heights (by default, all
+// the blocks), in height order
+func webAPIBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := webAPIPagination(r)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	height := dbGetBlockchainHeight()
+	from, err := webAPIIntParam(r, "from", 0)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := webAPIIntParam(r, "to", height)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > height {
+		to = height
+	}
+	total := 0
+	if to >= from {
+		total = to - from + 1
+	}
+	blocks := []webAPIBlock{}
+	for h := from + offset; h <= to && len(blocks) < limit; h++ {
+		dbb, err := dbGetBlockByHeight(h)
+		if err != nil {
+			log.Println("Cannot get block", h, err)
+			break
+		}
+		blocks = append(blocks, webAPINewBlock(dbb))
+	}
+	webAPIWrite(w, webAPIPage{Total: total, Offset: offset, Limit: limit, Items: blocks})
+}
+
+// /api/block/{height|hash}: the block's metadata, and its tables with their row counts
+func webAPIBlockHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var dbb *DbBlockchainBlock
+	var err error
+	// Block hashes are 64 hex digits; anything else is a height
+	if blockHashRegexp.MatchString(id) {
+		dbb, err = dbGetBlock(id)
+	} else if height, aerr := strconv.Atoi(id); aerr == nil {
+		dbb, err = dbGetBlockByHeight(height)
+	} else {
+		webAPIError(w, http.StatusBadRequest, "expecting a block height or hash")
+		return
+	}
+	if err != nil {
+		webAPIError(w, http.StatusNotFound, "block not found")
+		return
+	}
+	blk := webAPINewBlock(dbb)
+	b, err := lightOpenBlockByHeight(dbb.Height)
+	if err != nil {
+		log.Println("Cannot open block", dbb.Height, err)
+		webAPIError(w, http.StatusServiceUnavailable, "cannot open block")
+		return
+	}
+	blk.Tables, err = b.dbGetTables()
+	if cerr := b.Close(); cerr != nil {
+		log.Printf("webAPIBlockHandler b.Close: %v", cerr)
+	}
+	if err != nil {
+		log.Println("Cannot list tables of block", dbb.Height, err)
+		webAPIError(w, http.StatusInternalServerError, "cannot list tables")
+		return
+	}
+	webAPIWrite(w, blk)
+}
+
+// /api/keys: the public keys, in the order they were added to the blockchain
+func webAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := webAPIPagination(r)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	keys := []webAPIKey{}
+	for _, hash := range dbGetPublicKeyHashes(limit, offset) {
+		dbpk, err := dbGetPublicKey(hash)
+		if err != nil {
+			log.Println("Cannot get public key", hash, err)
+			continue
+		}
+		keys = append(keys, webAPINewKey(dbpk))
+	}
+	webAPIWrite(w, webAPIPage{Total: dbCountPublicKeys(), Offset: offset, Limit: limit, Items: keys})
+}
+
+// /api/key/{hash}: a public key
+func webAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	dbpk, err := dbGetPublicKey(mux.Vars(r)["hash"])
+	if err != nil {
+		webAPIError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	webAPIWrite(w, webAPINewKey(dbpk))
+}
+
+// /api/peers: the connected peers, ordered by address
+func webAPIPeersHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := webAPIPagination(r)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	peers := []webAPIPeer{}
+	p2pPeers.lock.With(func() {
+		for p2pc, timeConnected := range p2pPeers.peers {
+			if !p2pc.helloReceived {
+				continue
+			}
+			capabilities := []string{}
+			for capability := range p2pc.capabilities {
+				capabilities = append(capabilities, capability)
+			}
+			sort.Strings(capabilities)
+			peers = append(peers, webAPIPeer{
+				Address:         p2pc.address,
+				PeerID:          fmt.Sprintf("%x", p2pc.peerID),
+				KeyHash:         p2pc.peerKeyHash,
+				Outbound:        p2pc.outbound,
+				ListenPort:      p2pc.listenPort,
+				Connectable:     p2pc.isConnectable,
+				Light:           p2pc.light,
+				ChainHeight:     p2pc.chainHeight,
+				ProtocolVersion: p2pc.protocolVersion,
+				Capabilities:    capabilities,
+				TimeConnected:   timeConnected,
+			})
+		}
+	})
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+	total := len(peers)
+	start := offset
+	if start > total {
+		start = total
+	}
+	peers = peers[start:]
+	if len(peers) > limit {
+		peers = peers[:limit]
+	}
+	webAPIWrite(w, webAPIPage{Total: total, Offset: offset, Limit: limit, Items: peers})
+}
+
+// /api/query?q=&from=&to=&limit=&timeout=&unified=&index=: runs a read-only SQL query on each
+// block in the range of heights (by default, all the blocks except the genesis block), newest first,
+// or with unified=true, once over all the blocks in the range, or with index=true, on the index
+// database. The result rows are streamed as JSON lines, followed by a line with the summary:
+// {"end": {...}}. The query stops after limit rows or timeout seconds.
+func webAPIQueryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	if q == "" {
+		webAPIError(w, http.StatusBadRequest, "missing query")
+		return
+	}
+	if cfg.Light {
+		webAPIError(w, http.StatusNotImplemented, "light nodes don't store the blocks")
+		return
+	}
+	height := dbGetBlockchainHeight()
+	from, err := webAPIIntParam(r, "from", 1)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := webAPIIntParam(r, "to", height)
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := webAPIIntParam(r, "limit", webAPIQueryMaxRows)
+	if err != nil || limit < 1 || limit > webAPIQueryMaxRows {
+		webAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", webAPIQueryMaxRows))
+		return
+	}
+	unified, err := webAPIBoolParam(r, "unified")
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	useIndex, err := webAPIBoolParam(r, "index")
+	if err != nil {
+		webAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if useIndex && indexGetDb() == nil {
+		webAPIError(w, http.StatusNotImplemented, "the index database is not enabled")
+		return
+	}
+	maxTimeout := int(webAPIQueryTimeout / time.Second)
+	timeout, err := webAPIIntParam(r, "timeout", maxTimeout)
+	if err != nil || timeout < 1 || timeout > maxTimeout {
+		webAPIError(w, http.StatusBadRequest, fmt.Sprintf("timeout must be between 1 and %d seconds", maxTimeout))
+		return
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > height {
+		to = height
+	}
+
+	log.Println("HTTP running query", strconv.Quote(q), "for", r.RemoteAddr)
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	var end webAPIQueryEnd
+	emit := func(v interface{}) error {
+		if end.Rows >= limit {
+			end.Truncated = true
+			return errQueryStop
+		}
+		end.Rows++
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if flusher != nil && end.Rows%100 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if useIndex {
+		end.Blocks, err = indexQuery(ctx, q, nil, from, to, func(cols []string, row map[string]interface{}) error {
+			return emit(webAPIQueryUnifiedRow{Row: row})
+		})
+	} else if unified {
+		end.Blocks, err = blockchainQueryUnified(ctx, q, nil, from, to, func(cols []string, row map[string]interface{}) error {
+			return emit(webAPIQueryUnifiedRow{Row: row})
+		})
+	} else {
+		end.Blocks, end.Errors, err = blockchainQuery(ctx, q, nil, from, to, false, func(height int, hash string, cols []string, row map[string]interface{}) error {
+			return emit(webAPIQueryRow{Height: height, Hash: hash, Row: row})
+		})
+	}
+	if err == context.DeadlineExceeded {
+		end.Error = "timeout"
+	} else if err != nil {
+		end.Error = err.Error()
+	}
+	if err = enc.Encode(map[string]webAPIQueryEnd{"end": end}); err != nil {
+		log.Println(err)
+	}
+}
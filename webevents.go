@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /api/events streams the node's events as Server-Sent Events (text/event-stream), so that
+// applications don't need to poll:
+//
+//	event: key_added / key_revoked   data: {"height": ..., "pubkey_hash": ...}
+//	event: block                     data: the block's metadata and tables
+//	event: peer_connected / peer_disconnected   data: {"address": ..., "outbound": ...}
+//
+// The key events of a block are sent before the block event. The last event sent for each block
+// (the block event, or the last key event if block events aren't selected) has the block's height
+// as its id, so that a client which reconnects with the standard Last-Event-ID header resumes with
+// the next block, or with the events of a block it has received only some of. The from query
+// parameter sets the first height to send when there's no Last-Event-ID (browsers reconnect to the
+// same URL, so it mustn't override Last-Event-ID); without either, only blocks accepted after
+// connecting are sent. Blocks and key changes are read from the database
+// (the block-accepted events only trigger that), so they are never missed, while peer events
+// which arrive when the client is too slow are dropped. The types query parameter limits the
+// events to a comma-separated list of: block, key, peer.
+
+// The event types which can be selected with the types query parameter
+var webEventsTypes = []string{"block", "key", "peer"}
+
+// How often a comment is sent to keep the connection open, and the database is checked for new
+// blocks in case block-accepted events were dropped
+const webEventsKeepAliveInterval = 15 * time.Second
+
+// The most blocks read from the database at once while catching up
+const webEventsBatchSize = 100
+
+// The data of key_added and key_revoked events
+type webEventKey struct {
+	Height        int    `json:"height"`
+	PublicKeyHash string `json:"pubkey_hash"`
+}
+
+// The data of peer_connected and peer_disconnected events
+type webEventPeer struct {
+	Address  string `json:"address"`
+	Outbound bool   `json:"outbound"`
+}
+
+// A client of the event stream
+type webEventsStream struct {
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	types      []string
+	nextHeight int // the height of the next block to send
+}
+
+// /api/events?from=&types=: streams the events described above
+func webAPIEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		webAPIError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	s := webEventsStream{w: w, flusher: flusher, types: webEventsTypes}
+	if t := r.FormValue("types"); t != "" {
+		s.types = strings.Split(t, ",")
+		for _, eventType := range s.types {
+			if !inStrings(eventType, webEventsTypes) {
+				webAPIError(w, http.StatusBadRequest, fmt.Sprintf("unknown event type %s (expecting: %s)", eventType, strings.Join(webEventsTypes, ", ")))
+				return
+			}
+		}
+	}
+	// Subscribe before reading the current height, so no block is missed
+	blockEvents := eventBus.Subscribe(busEventBlockAccepted, 16)
+	defer eventBus.Unsubscribe(blockEvents)
+	peerConnectedEvents := eventBus.Subscribe(busEventPeerConnected, 16)
+	defer eventBus.Unsubscribe(peerConnectedEvents)
+	peerDisconnectedEvents := eventBus.Subscribe(busEventPeerDisconnected, 16)
+	defer eventBus.Unsubscribe(peerDisconnectedEvents)
+
+	from, err := webAPIIntParam(r, "from", dbGetBlockchainHeight()+1)
+	if err != nil || from < 0 {
+		webAPIError(w, http.StatusBadRequest, "invalid from")
+		return
+	}
+	s.nextHeight = from
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		height, err := strconv.Atoi(lastID)
+		if err != nil || height < 0 {
+			webAPIError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+		s.nextHeight = height + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	log.Println("HTTP streaming events from height", s.nextHeight, "to", r.RemoteAddr)
+
+	ticker := time.NewTicker(webEventsKeepAliveInterval)
+	defer ticker.Stop()
+	err = s.sendBlocks()
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-blockEvents:
+			err = s.sendBlocks()
+		case ev := <-peerConnectedEvents:
+			err = s.sendPeer("peer_connected", ev.payload.(busPeerEvent))
+		case ev := <-peerDisconnectedEvents:
+			err = s.sendPeer("peer_disconnected", ev.payload.(busPeerEvent))
+		case <-ticker.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err == nil {
+				flusher.Flush()
+				err = s.sendBlocks()
+			}
+		}
+	}
+	if r.Context().Err() == nil {
+		log.Println("Error streaming events to", r.RemoteAddr, err)
+	}
+}
+
+// Sends the blocks from nextHeight to the current height, each preceded by its key changes
+func (s *webEventsStream) sendBlocks() error {
+	height := dbGetBlockchainHeight()
+	for s.nextHeight <= height {
+		maxHeight := s.nextHeight + webEventsBatchSize - 1
+		if maxHeight > height {
+			maxHeight = height
+		}
+		var keyChanges []DbKeyChange
+		if inStrings("key", s.types) {
+			keyChanges = dbGetKeyChanges(s.nextHeight, maxHeight)
+		}
+		sendBlock := inStrings("block", s.types)
+		for ; s.nextHeight <= maxHeight; s.nextHeight++ {
+			id := strconv.Itoa(s.nextHeight)
+			for len(keyChanges) != 0 && keyChanges[0].Height == s.nextHeight {
+				eventType := "key_added"
+				if keyChanges[0].Revoked {
+					eventType = "key_revoked"
+				}
+				keyID := ""
+				if !sendBlock && (len(keyChanges) == 1 || keyChanges[1].Height != s.nextHeight) {
+					keyID = id
+				}
+				if err := s.send(eventType, keyID, webEventKey{Height: s.nextHeight, PublicKeyHash: keyChanges[0].PublicKeyHash}); err != nil {
+					return err
+				}
+				keyChanges = keyChanges[1:]
+			}
+			if !sendBlock {
+				continue
+			}
+			dbb, err := dbGetBlockByHeight(s.nextHeight)
+			if err != nil {
+				return err
+			}
+			if err = s.send("block", id, webEventsNewBlock(dbb)); err != nil {
+				return err
+			}
+		}
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// Returns the data of a block event: the block's metadata, and its tables if the block file is
+// stored locally (light nodes don't have most of them)
+func webEventsNewBlock(dbb *DbBlockchainBlock) webAPIBlock {
+	blk := webAPINewBlock(dbb)
+	if !fileExists(blockchainGetFilename(dbb.Height)) {
+		return blk
+	}
+	b, err := OpenBlockByHeight(dbb.Height)
+	if err != nil {
+		log.Println("Cannot open block", dbb.Height, err)
+		return blk
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			log.Printf("webEventsNewBlock b.Close: %v", err)
+		}
+	}()
+	tables, err := b.dbGetTables()
+	if err != nil {
+		log.Println("Cannot list tables of block", dbb.Height, err)
+		return blk
+	}
+	for _, t := range tables {
+		// The metadata tables are in every block
+		if t.Name != "_meta" && t.Name != "_keys" {
+			blk.Tables = append(blk.Tables, t)
+		}
+	}
+	return blk
+}
+
+func (s *webEventsStream) sendPeer(eventType string, ev busPeerEvent) error {
+	if !inStrings("peer", s.types) {
+		return nil
+	}
+	if err := s.send(eventType, "", webEventPeer{Address: ev.address, Outbound: ev.outbound}); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Writes an event, with an id if it's not empty
+func (s *webEventsStream) send(eventType string, id string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		_, err = fmt.Fprintf(s.w, "event: %s\nid: %s\ndata: %s\n\n", eventType, id, buf)
+	} else {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", eventType, buf)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the type and id of each event in the stream, as "type id"
+func testParseEvents(body string) []string {
+	events := []string{}
+	for _, event := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var eventType, id string
+		for _, line := range strings.Split(event, "\n") {
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "id: ") {
+				id = strings.TrimPrefix(line, "id: ")
+			}
+		}
+		if eventType != "" {
+			events = append(events, strings.TrimSpace(eventType+" "+id))
+		}
+	}
+	return events
+}
+
+func TestWebEventsStreamSendBlocks(t *testing.T) {
+	testDbInit(t)
+	for h := 0; h <= 3; h++ {
+		if err := dbInsertBlock(&DbBlockchainBlock{Height: h, Hash: testBlockHash(fmt.Sprint(h)), TimeAccepted: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two keys are added in block 1 and one of them is revoked in block 2; block 3 has no key changes
+	testKey(t, 1)
+	_, revokedHash := testKey(t, 1)
+	dbRevokePublicKey(revokedHash, 2, time.Now())
+
+	tests := []struct {
+		name  string
+		types []string
+		from  int
+		want  []string
+	}{
+		{"blocks and keys", []string{"block", "key"}, 1, []string{"key_added", "key_added", "block 1", "key_revoked", "block 2", "block 3"}},
+		{"keys only", []string{"key"}, 1, []string{"key_added", "key_added 1", "key_revoked 2"}},
+		{"blocks only", []string{"block"}, 1, []string{"block 1", "block 2", "block 3"}},
+		{"resumed", []string{"block", "key"}, 2, []string{"key_revoked", "block 2", "block 3"}},
+		{"resumed after the last block", []string{"block", "key"}, 4, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s := webEventsStream{w: w, flusher: w, types: tt.types, nextHeight: tt.from}
+			if err := s.sendBlocks(); err != nil {
+				t.Fatal(err)
+			}
+			if got := testParseEvents(w.Body.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got events %q, want %q", got, tt.want)
+			}
+			if s.nextHeight != 4 {
+				t.Errorf("next height %d, want 4", s.nextHeight)
+			}
+		})
+	}
+}